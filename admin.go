@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth guards destructive endpoints with the ADMIN_TOKEN secret, sent as X-Admin-Token.
+// With no token configured the admin endpoints are disabled.
+func AdminAuth(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled (ADMIN_TOKEN not set)"})
+			return
+		}
+		provided := c.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ClearDeviceDataHandler deletes every stored sample; an explicit admin action now that ingestion upserts.
+// Backfill progress in db goes too, otherwise a later backfill would skip the wiped days as done.
+func ClearDeviceDataHandler(store HistoryStore, db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		//progress first: if clearing history then fails, the worst case is a refetch
+		if _, err := db.Exec("DELETE FROM backfill_progress"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to clear backfill progress: %v", err)})
+			return
+		}
+		if err := store.ClearHistory(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to clear device data: %v", err)})
+			return
+		}
+		fmt.Println("Device data history cleared by admin request.")
+		c.JSON(http.StatusOK, gin.H{"message": "Device data history cleared"})
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aggregateFns are the per-bucket reductions /api/history/aggregate supports
+var aggregateFns = []string{"avg", "min", "max", "last"}
+
+var defaultAggregateFields = []string{"pv_input_power_w", "battery_power_w", "load_power_w", "battery_percentage"}
+
+// maxAggregateBuckets caps the buckets per device in one response
+const maxAggregateBuckets = 10000
+
+// defaultAggregateRange is how far back /api/history/aggregate reads when no range is given
+const defaultAggregateRange = 24 * time.Hour
+
+// Series is one device's downsampled history: Values[field][i] belongs to the bucket
+// starting at Timestamps[i], and is null when no sample in that bucket had the field
+type Series struct {
+	DeviceSn   string                `json:"deviceSn"`
+	Timestamps []string              `json:"timestamps"`
+	Samples    []int                 `json:"samples"` // raw rows in each bucket
+	Values     map[string][]*float64 `json:"values"`
+}
+
+// parseInterval reads a bucket width: a duration such as 15m or 1h that divides a day
+// evenly, so buckets line up with the plant's midnight, or 1d for calendar days
+func parseInterval(value string) (time.Duration, error) {
+	if value == "1d" {
+		return 24 * time.Hour, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < time.Minute || interval > 24*time.Hour || (24*time.Hour)%interval != 0 {
+		return 0, fmt.Errorf("invalid interval %q, use a whole number of minutes or hours that divides a day (e.g. 15m, 1h) or 1d", value)
+	}
+	return interval, nil
+}
+
+// bucketStart returns the start of the bucket holding t. Buckets are counted from the
+// plant-local midnight, so a 1d bucket is a calendar day even across DST changes.
+func bucketStart(t time.Time, interval time.Duration) time.Time {
+	local := t.In(plantLocation)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, plantLocation)
+	if interval >= 24*time.Hour {
+		return midnight
+	}
+	return midnight.Add(local.Sub(midnight).Truncate(interval))
+}
+
+// BucketQuery selects history grouped into Interval-wide buckets starting at Origin and every
+// Interval after it. Range must be bounded and start at or after Origin.
+type BucketQuery struct {
+	DeviceSn string
+	Range    TimeRange
+	Origin   time.Time
+	Interval time.Duration
+	Fields   []string
+	Fn       string
+}
+
+// Bucket is one device's samples in one bucket. Values[i] is the reduction of Fields[i], except
+// for avg, where it is the sum of the Counts[i] samples that had the field.
+type Bucket struct {
+	DeviceSn string
+	Start    int64 // epoch seconds
+	Samples  int
+	Values   []sql.NullFloat64
+	Counts   []int
+}
+
+// bucketGrid is a stretch of time over which buckets counted from Origin line up with bucketStart
+type bucketGrid struct {
+	Range  TimeRange
+	Origin time.Time
+}
+
+// bucketGrids splits timeRange into stretches with fixed bucket grids. A grid starts at a
+// plant-local midnight and runs over whole 24-hour days; a DST change day ends it, since the
+// following midnight isn't a multiple of a day away from the grid's origin.
+func bucketGrids(timeRange TimeRange) []bucketGrid {
+	var grids []bucketGrid
+	from := timeRange.From
+	for from.Before(timeRange.To) {
+		origin := bucketStart(from, 24*time.Hour)
+		end := origin
+		for end.Before(timeRange.To) {
+			next := end.AddDate(0, 0, 1)
+			dayLength := next.Sub(end)
+			end = next
+			if dayLength != 24*time.Hour {
+				break
+			}
+		}
+		if end.After(timeRange.To) {
+			end = timeRange.To
+		}
+		grids = append(grids, bucketGrid{Range: TimeRange{From: from, To: end}, Origin: origin})
+		from = end
+	}
+	return grids
+}
+
+// bucketSeries turns buckets into one series per device, reducing each field with fn. Buckets
+// whose starts fall in the same bucketStart bucket (the long day of a DST change, bucketed 1d)
+// are merged.
+func bucketSeries(buckets []Bucket, fields []string, interval time.Duration, fn string) []Series {
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].DeviceSn != buckets[j].DeviceSn {
+			return buckets[i].DeviceSn < buckets[j].DeviceSn
+		}
+		return buckets[i].Start < buckets[j].Start
+	})
+
+	series := []Series{}
+	var current *Series
+	var bucket time.Time
+	var values []sql.NullFloat64
+	var counts []int
+
+	flush := func() {
+		if current == nil || len(current.Timestamps) == 0 {
+			return
+		}
+		last := len(current.Timestamps) - 1
+		for i, field := range fields {
+			if !values[i].Valid || (fn == "avg" && counts[i] == 0) {
+				continue
+			}
+			value := values[i].Float64
+			if fn == "avg" {
+				value /= float64(counts[i])
+			}
+			rounded := math.Round(value*100) / 100
+			current.Values[field][last] = &rounded
+		}
+	}
+
+	for _, b := range buckets {
+		if current == nil || current.DeviceSn != b.DeviceSn {
+			flush()
+			series = append(series, Series{DeviceSn: b.DeviceSn, Timestamps: []string{}, Samples: []int{}, Values: map[string][]*float64{}})
+			current = &series[len(series)-1]
+			bucket = time.Time{}
+		}
+
+		start := bucketStart(time.Unix(b.Start, 0), interval)
+		if !start.Equal(bucket) {
+			flush()
+			bucket = start
+			current.Timestamps = append(current.Timestamps, start.Format(time.RFC3339))
+			current.Samples = append(current.Samples, 0)
+			for _, field := range fields {
+				current.Values[field] = append(current.Values[field], nil)
+			}
+			values = make([]sql.NullFloat64, len(fields))
+			counts = make([]int, len(fields))
+		}
+		current.Samples[len(current.Samples)-1] += b.Samples
+
+		for i, value := range b.Values {
+			if !value.Valid {
+				continue
+			}
+			v := value.Float64
+			switch {
+			case !values[i].Valid, fn == "last",
+				fn == "min" && v < values[i].Float64,
+				fn == "max" && v > values[i].Float64:
+				values[i] = value
+			case fn == "avg":
+				values[i].Float64 += v
+			}
+			if fn == "avg" {
+				counts[i] += b.Counts[i]
+			}
+		}
+	}
+	flush()
+	return series
+}
+
+// AggregateHistoryHandler serves /api/history/aggregate: history in a time range (from/to or date,
+// as for /api/history/filtered; the last day when neither is given) bucketed by interval, with
+// each of fields reduced by fn. device_sn restricts it to one device; otherwise each device gets
+// its own series. The bucketing happens in the database, so only the buckets are read.
+func AggregateHistoryHandler(store HistoryStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeRange, err := historyTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		interval, err := parseInterval(c.DefaultQuery("interval", "1h"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		fn := c.DefaultQuery("fn", "avg")
+		if !slices.Contains(aggregateFns, fn) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("fn must be one of %s", strings.Join(aggregateFns, ", "))})
+			return
+		}
+
+		fields := defaultAggregateFields
+		if fieldsStr := c.Query("fields"); fieldsStr != "" {
+			fields = strings.Split(fieldsStr, ",")
+			for _, field := range fields {
+				if !slices.Contains(numericColumns, field) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown field %q, expected one of %s", field, strings.Join(numericColumns, ", "))})
+					return
+				}
+			}
+		}
+
+		//the range must be bounded, so the bucket count (and the rows read) are too
+		switch {
+		case timeRange.From.IsZero() && timeRange.To.IsZero():
+			now := time.Now()
+			timeRange = TimeRange{From: bucketStart(now.Add(-defaultAggregateRange), interval), To: now}
+		case timeRange.From.IsZero() || timeRange.To.IsZero():
+			c.JSON(http.StatusBadRequest, gin.H{"error": "give both from and to, or neither for the last 24 hours"})
+			return
+		}
+		if timeRange.To.Sub(timeRange.From)/interval > maxAggregateBuckets {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("more than %d buckets, use a wider interval or a shorter range", maxAggregateBuckets)})
+			return
+		}
+
+		var buckets []Bucket
+		for _, grid := range bucketGrids(timeRange) {
+			gridBuckets, err := store.HistoryBuckets(BucketQuery{
+				DeviceSn: c.Query("device_sn"),
+				Range:    grid.Range,
+				Origin:   grid.Origin,
+				Interval: interval,
+				Fields:   fields,
+				Fn:       fn,
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching history from database"})
+				return
+			}
+			buckets = append(buckets, gridBuckets...)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"interval": c.DefaultQuery("interval", "1h"),
+			"fn":       fn,
+			"fields":   fields,
+			"from":     timeRange.From.In(plantLocation).Format(time.RFC3339),
+			"to":       timeRange.To.In(plantLocation).Format(time.RFC3339),
+			"series":   bucketSeries(buckets, fields, interval, fn),
+		})
+	}
+}
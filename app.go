@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// App holds the dependencies shared by the HTTP server and the CLI subcommands
+type App struct {
+	DB              *sql.DB // local SQLite database for devices, events, backfill state and the archive
+	Store           Store   // history and calibration, in DB unless HISTORY_STORE says otherwise
+	Client          *FelicityClient
+	Tokens          *TokenManager
+	Devices         []string // serial numbers of the inverters to ingest; see ensureDevices
+	HistoryPageSize int
+	Energy          EnergyOptions
+
+	discovered bool // device metadata was already refreshed during startup
+}
+
+// NewApp reads configuration from .env/the environment, opens the database and wires up
+// the Felicity client and its token manager
+func NewApp() (*App, error) {
+	err := godotenv.Load()
+	if err != nil {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	username := os.Getenv("USERNAME")
+	password := os.Getenv("PASSWORD")
+	devices := parseDeviceList(os.Getenv("DEVICE_SNS"), os.Getenv("DEVICE_SN"))
+
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("USERNAME and PASSWORD must be set in .env file") // Ensure variables are set
+	}
+
+	//device times are plant-local; this must be set before migrations timestamp legacy rows below
+	if err := setPlantTimezone(os.Getenv("PLANT_TIMEZONE")); err != nil {
+		return nil, err
+	}
+
+	//open db and bring its schema up to date
+	db, err := sql.Open("sqlite3", dbFileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	if _, err := MigrateUp(db, dialectSQLite); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store, err := NewStore(os.Getenv("HISTORY_STORE"), db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error setting up history store: %w", err)
+	}
+
+	tokenStore, err := NewTokenStore(os.Getenv("TOKEN_STORE"), db)
+	if err != nil {
+		store.Close()
+		db.Close()
+		return nil, fmt.Errorf("error setting up token store: %w", err)
+	}
+
+	felicityClient := NewFelicityClient(os.Getenv("FELICITY_BASE_URL"), nil, envDuration("FELICITY_TIMEOUT", defaultClientTimeout))
+	if userAgent := os.Getenv("FELICITY_USER_AGENT"); userAgent != "" {
+		felicityClient.UserAgent = userAgent
+	}
+	felicityClient.Retry.MaxAttempts = envInt("FELICITY_MAX_ATTEMPTS", defaultRetryPolicy.MaxAttempts)
+	//one bucket for every upstream call so backfills and polling can't get the account throttled
+	if rate := envFloat("FELICITY_RATE_LIMIT", 2); rate > 0 {
+		felicityClient.Limiter = NewRateLimiter(rate, envInt("FELICITY_RATE_BURST", 5))
+	}
+
+	if os.Getenv("ARCHIVE_RESPONSES") != "false" {
+		//ARCHIVE_RETENTION_DAYS unset keeps every response
+		felicityClient.Archive = NewSQLiteResponseArchive(db, time.Duration(envInt("ARCHIVE_RETENTION_DAYS", 0))*24*time.Hour)
+	}
+
+	//all Felicity calls share one token manager so concurrent requests don't race on login/refresh
+	tokenManager := NewTokenManager(felicityClient, username, password, tokenStore)
+	felicityClient.Tokens = tokenManager
+
+	app := &App{
+		DB:              db,
+		Store:           store,
+		Client:          felicityClient,
+		Tokens:          tokenManager,
+		Devices:         devices,
+		HistoryPageSize: envInt("HISTORY_PAGE_SIZE", 100),
+		Energy: EnergyOptions{
+			MaxGap:            envDuration("ENERGY_MAX_GAP", 15*time.Minute),
+			DischargePositive: os.Getenv("BATTERY_DISCHARGE_POSITIVE") == "true",
+		},
+	}
+	return app, nil
+}
+
+// ensureDevices fills app.Devices from the account when DEVICE_SNS/DEVICE_SN is unset, so every
+// device on it is ingested. Only the server and backfill call it; commands that work on stored
+// data alone shouldn't need the API to be reachable.
+func (app *App) ensureDevices() error {
+	if len(app.Devices) > 0 {
+		return nil
+	}
+	return app.discoverDevices()
+}
+
+// Close closes the history store and the database
+func (app *App) Close() error {
+	return errors.Join(app.Store.Close(), app.DB.Close())
+}
+
+// discoverDevices fills app.Devices from the account's device list, falling back to the
+// devices saved by an earlier discovery when the API can't be reached
+func (app *App) discoverDevices() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	serials, err := DiscoverDevices(ctx, app.DB, app.Client)
+	app.discovered = err == nil
+	if err != nil {
+		fmt.Println("Device discovery failed, using previously discovered devices:", err)
+		serials, err = knownDeviceSerials(app.DB)
+		if err != nil {
+			return err
+		}
+	}
+	if len(serials) == 0 {
+		return fmt.Errorf("no devices configured (DEVICE_SNS/DEVICE_SN) or found on the account")
+	}
+	app.Devices = serials
+	return nil
+}
+
+// parseDeviceList reads the comma-separated DEVICE_SNS list, falling back to the single DEVICE_SN
+func parseDeviceList(deviceSNs, deviceSN string) []string {
+	if deviceSNs == "" {
+		deviceSNs = deviceSN
+	}
+
+	var devices []string
+	seen := make(map[string]bool)
+	for _, sn := range strings.Split(deviceSNs, ",") {
+		sn = strings.TrimSpace(sn)
+		if sn == "" || seen[sn] {
+			continue
+		}
+		seen[sn] = true
+		devices = append(devices, sn)
+	}
+	return devices
+}
+
+// HasDevice reports whether sn is one of the configured devices
+func (app *App) HasDevice(sn string) bool {
+	return slices.Contains(app.Devices, sn)
+}
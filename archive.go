@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const archiveEndpointDeviceDataHistory = "deviceDataHistory"
+
+// ResponseArchive stores raw upstream response bodies for later replay
+type ResponseArchive interface {
+	Save(ctx context.Context, endpoint, deviceSn string, params url.Values, body []byte) error
+}
+
+// SQLiteResponseArchive keeps gzip-compressed response bodies in the raw_responses table,
+// a row per fetch; a body identical to one already archived for the request is not stored again
+type SQLiteResponseArchive struct {
+	db        *sql.DB
+	retention time.Duration // responses fetched longer ago than this are pruned; 0 keeps them all
+}
+
+func NewSQLiteResponseArchive(db *sql.DB, retention time.Duration) *SQLiteResponseArchive {
+	return &SQLiteResponseArchive{db: db, retention: retention}
+}
+
+// Save appends body to the archive, unless the same request (endpoint, device and parameters)
+// already has a byte-identical body archived
+func (a *SQLiteResponseArchive) Save(ctx context.Context, endpoint, deviceSn string, params url.Values, body []byte) error {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	var archived int
+	err := a.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM raw_responses WHERE endpoint = ? AND device_sn = ? AND params = ? AND body_sha256 = ?",
+		endpoint, deviceSn, params.Encode(), hash).Scan(&archived)
+	if err != nil {
+		return fmt.Errorf("error checking archived response: %w", err)
+	}
+	if archived > 0 {
+		return a.prune(ctx, endpoint)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return fmt.Errorf("error compressing response: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error compressing response: %w", err)
+	}
+
+	_, err = a.db.ExecContext(ctx,
+		"INSERT INTO raw_responses (endpoint, device_sn, params, fetched_at, body_gzip, body_size, body_sha256) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		endpoint, deviceSn, params.Encode(), time.Now().UTC(), compressed.Bytes(), len(body), hash,
+	)
+	if err != nil {
+		return fmt.Errorf("error archiving response: %w", err)
+	}
+	return a.prune(ctx, endpoint)
+}
+
+// prune deletes endpoint's responses that are past the retention period
+func (a *SQLiteResponseArchive) prune(ctx context.Context, endpoint string) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	_, err := a.db.ExecContext(ctx, "DELETE FROM raw_responses WHERE endpoint = ? AND fetched_at < ?", endpoint, time.Now().UTC().Add(-a.retention))
+	if err != nil {
+		return fmt.Errorf("error pruning archived responses: %w", err)
+	}
+	return nil
+}
+
+// loadArchivedBody returns the decompressed body of one archived response
+func loadArchivedBody(db *sql.DB, id int64) ([]byte, error) {
+	var compressed []byte
+	if err := db.QueryRow("SELECT body_gzip FROM raw_responses WHERE id = ?", id).Scan(&compressed); err != nil {
+		return nil, fmt.Errorf("error reading archived response %d: %w", id, err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing archived response %d: %w", id, err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// ReprocessArchive replays every archived history response, oldest first so the newest body of
+// a request wins, upserting its samples with the current calibration and recording their events.
+// With fromScratch the archived devices' samples, summaries and history events are deleted
+// first, so what is stored for them is exactly what the archive holds; otherwise samples stored
+// before archiving started, or pruned from it, are kept. The summaries of every replayed day
+// are recomputed once the replay is done, and then the store's rollups.
+func ReprocessArchive(ctx context.Context, db *sql.DB, store Store, energy EnergyOptions, fromScratch bool, report func(done, total, rows int)) (int, error) {
+	//collect ids up front; holding a read cursor open while writing would lock SQLite
+	rows, err := db.QueryContext(ctx, "SELECT id, COALESCE(device_sn, '') FROM raw_responses WHERE endpoint = ? ORDER BY fetched_at, id", archiveEndpointDeviceDataHistory)
+	if err != nil {
+		return 0, fmt.Errorf("error querying archived responses: %w", err)
+	}
+	var ids []int64
+	var devices []string
+	for rows.Next() {
+		var id int64
+		var deviceSn string
+		if err := rows.Scan(&id, &deviceSn); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning archived response: %w", err)
+		}
+		ids = append(ids, id)
+		if deviceSn != "" && !slices.Contains(devices, deviceSn) {
+			devices = append(devices, deviceSn)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating archived responses: %w", err)
+	}
+
+	if fromScratch {
+		if err := store.ClearDeviceHistory(devices); err != nil {
+			return 0, err
+		}
+		if err := clearHistoryEvents(db, devices); err != nil {
+			return 0, err
+		}
+	}
+
+	stored := 0
+	replayedDays := make(map[string]map[string]bool)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return stored, err
+		}
+
+		body, err := loadArchivedBody(db, id)
+		if err != nil {
+			return stored, err
+		}
+		var response DeviceDataHistoryResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			fmt.Printf("Skipping archived response %d: %v\n", id, err)
+			continue
+		}
+		dataList := response.Data.DataList
+		if err := store.SaveHistory(dataList); err != nil {
+			return stored, fmt.Errorf("error replaying archived response %d: %w", id, err)
+		}
+		if err := recordHistoryEvents(db, dataList); err != nil {
+			return stored, fmt.Errorf("error recording events of archived response %d: %w", id, err)
+		}
+		for deviceSn, days := range summaryDays(dataList, energy.MaxGap) {
+			if replayedDays[deviceSn] == nil {
+				replayedDays[deviceSn] = make(map[string]bool)
+			}
+			for _, day := range days {
+				replayedDays[deviceSn][day] = true
+			}
+		}
+		stored += len(dataList)
+		report(i+1, len(ids), stored)
+	}
+
+	//summaries once every page of a day is back, rather than after each response
+	for _, deviceSn := range slices.Sorted(maps.Keys(replayedDays)) {
+		for _, day := range slices.Sorted(maps.Keys(replayedDays[deviceSn])) {
+			if err := RecomputeDailySummary(store, energy, deviceSn, day); err != nil {
+				return stored, err
+			}
+		}
+	}
+	//the replay may have rewritten any of history, so every rollup bucket is recomputed
+	if err := store.RefreshRollups(TimeRange{}); err != nil {
+		return stored, err
+	}
+	return stored, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// historyBody builds an archived deviceDataHistory response holding rows
+func historyBody(t *testing.T, rows []map[string]interface{}) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{"code": apiCodeOK, "data": map[string]interface{}{"datalist": rows}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestResponseArchiveAppendsChangedBodies(t *testing.T) {
+	store := newTestStore(t)
+	archive := NewSQLiteResponseArchive(store.db, 0)
+	ctx := context.Background()
+	params := url.Values{"deviceSn": {"SN1"}, "dateStr": {"2024-01-02"}, "pageNum": {"1"}}
+
+	first := historyBody(t, []map[string]interface{}{historyRow("2024-01-02 10:00:00", "100")})
+	second := historyBody(t, []map[string]interface{}{historyRow("2024-01-02 10:00:00", "100"), historyRow("2024-01-02 10:05:00", "200")})
+	for _, body := range [][]byte{first, first, second, first} {
+		if err := archive.Save(ctx, archiveEndpointDeviceDataHistory, "SN1", params, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the same first body on another day is another request
+	if err := archive.Save(ctx, archiveEndpointDeviceDataHistory, "SN1", url.Values{"dateStr": {"2024-01-03"}}, first); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM raw_responses").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("%d archived responses, want 3: repeats of a body are skipped, nothing is overwritten", rows)
+	}
+}
+
+func TestReprocessArchiveFromScratch(t *testing.T) {
+	store := newTestStore(t)
+	archive := NewSQLiteResponseArchive(store.db, 0)
+	opts := EnergyOptions{MaxGap: time.Hour}
+	ctx := context.Background()
+
+	fault := historyRow("2024-01-02 10:00:00", "1000")
+	fault["faultCode"] = "7"
+	body := historyBody(t, []map[string]interface{}{fault, historyRow("2024-01-02 11:00:00", "1000")})
+	if err := archive.Save(ctx, archiveEndpointDeviceDataHistory, "SN1", url.Values{"dateStr": {"2024-01-02"}}, body); err != nil {
+		t.Fatal(err)
+	}
+
+	//a sample the archive never saw, a stale summary and a stale event, all for the archived device
+	if err := store.SaveHistory([]DeviceData{{DeviceSn: "SN1", DeviceDataTime: "2024-01-01 12:00:00", PvTotalPower: "500"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveDailySummary(DailySummary{DeviceSn: "SN1", Day: "2024-01-01", PvKWh: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordHistoryEvents(store.db, []DeviceData{{DeviceSn: "SN1", DeviceDataTime: "2024-01-01 12:00:00", WarningCode: "3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ReprocessArchive(ctx, store.db, store, opts, true, func(int, int, int) {})
+	if err != nil || stored != 2 {
+		t.Fatalf("ReprocessArchive = %d, %v; want 2 rows", stored, err)
+	}
+
+	all, err := store.AllHistory("SN1", TimeRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].LocalTime != "2024-01-02 10:00:00" {
+		t.Errorf("history after reprocess = %+v, want only the 2 archived samples", all)
+	}
+	summaries, err := store.DailySummaries("SN1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Day != "2024-01-02" || !near(summaries[0].PvKWh, 1) {
+		t.Errorf("summaries after reprocess = %+v, want 1 kWh on 2024-01-02 only", summaries)
+	}
+	events, err := GetEvents(store.db, EventFilter{DeviceSn: "SN1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Code != "F7" {
+		t.Errorf("events after reprocess = %+v, want the replayed F7 fault only", events)
+	}
+}
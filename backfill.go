@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const backfillDateLayout = "2006-01-02"
+
+// ErrBackfillRunning is returned when a backfill is requested while another is in progress
+var ErrBackfillRunning = errors.New("a backfill is already running")
+
+// BackfillStatus reports the progress of a backfill job
+type BackfillStatus struct {
+	JobID       int64      `json:"jobId"`
+	Running     bool       `json:"running"`
+	DeviceSN    string     `json:"deviceSn"`
+	Start       string     `json:"start"`
+	End         string     `json:"end"`
+	CurrentDay  string     `json:"currentDay,omitempty"`
+	DaysTotal   int        `json:"daysTotal"`
+	DaysDone    int        `json:"daysDone"`
+	DaysSkipped int        `json:"daysSkipped"` // already completed by an earlier run
+	Rows        int        `json:"rows"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+	Error       string     `json:"error,omitempty"`
+
+	JobsTotal int      `json:"jobsTotal,omitempty"` // devices in this request
+	JobsDone  int      `json:"jobsDone,omitempty"`
+	Queued    []string `json:"queued,omitempty"` // devices still waiting
+}
+
+// parseBackfillRange parses start/end dates (YYYY-MM-DD, inclusive) and checks they make sense
+func parseBackfillRange(startStr, endStr string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(backfillDateLayout, startStr, plantLocation)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start date %q, expected YYYY-MM-DD", startStr)
+	}
+	end, err := time.ParseInLocation(backfillDateLayout, endStr, plantLocation)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end date %q, expected YYYY-MM-DD", endStr)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end date %s is before start date %s", endStr, startStr)
+	}
+	today := plantToday().Format(backfillDateLayout)
+	if endStr > today {
+		return time.Time{}, time.Time{}, fmt.Errorf("end date %s is in the future", endStr)
+	}
+	return start, end, nil
+}
+
+// RunBackfill fetches device history day by day from start to end (inclusive). Days recorded in
+// backfill_progress are skipped, so re-running an interrupted range resumes where it stopped.
+// Today is never marked complete because its data is still arriving. The store's rollups of the
+// range are refreshed at the end, as the backfilled days are usually older than their policies reach.
+func RunBackfill(ctx context.Context, app *App, deviceSn string, start, end time.Time, report func(BackfillStatus)) (BackfillStatus, error) {
+	status := BackfillStatus{
+		DeviceSN:  deviceSn,
+		Start:     start.Format(backfillDateLayout),
+		End:       end.Format(backfillDateLayout),
+		DaysTotal: int(math.Round(end.Sub(start).Hours()/24)) + 1, // rounded so DST days count once
+	}
+	today := plantToday().Format(backfillDateLayout)
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		dateStr := day.Format(backfillDateLayout)
+		status.CurrentDay = dateStr
+
+		var completed int
+		err := app.DB.QueryRow("SELECT COUNT(*) FROM backfill_progress WHERE device_sn = ? AND day = ?", deviceSn, dateStr).Scan(&completed)
+		if err != nil {
+			return status, fmt.Errorf("error checking backfill progress: %w", err)
+		}
+		if completed > 0 {
+			status.DaysSkipped++
+			status.DaysDone++
+			report(status)
+			continue
+		}
+
+		rows := 0
+		err = app.Client.FetchAllDeviceDataHistory(ctx, deviceSn, dateStr, app.HistoryPageSize, func(page []DeviceData, progress HistoryProgress) error {
+			if err := logDataToDB(app.DB, app.Store, app.Energy, page); err != nil {
+				return fmt.Errorf("error logging data to database: %w", err)
+			}
+			rows += len(page)
+			return nil
+		})
+		if err != nil {
+			return status, fmt.Errorf("backfill of %s failed: %w", dateStr, err)
+		}
+
+		if dateStr != today {
+			_, err = app.DB.Exec("INSERT OR REPLACE INTO backfill_progress (device_sn, day, rows) VALUES (?, ?, ?)", deviceSn, dateStr, rows)
+			if err != nil {
+				return status, fmt.Errorf("error recording backfill progress: %w", err)
+			}
+		}
+
+		status.Rows += rows
+		status.DaysDone++
+		report(status)
+	}
+	status.CurrentDay = ""
+	if status.Rows > 0 {
+		if err := app.Store.RefreshRollups(TimeRange{From: start, To: end.AddDate(0, 0, 1)}); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// Backfiller runs backfills in the background for the HTTP API, one device at a time, and
+// resumes jobs that were interrupted by a crash or restart
+type Backfiller struct {
+	app *App
+
+	mu      sync.Mutex
+	running bool
+	status  BackfillStatus
+}
+
+// backfillJob is one device's date range, persisted in backfill_jobs
+type backfillJob struct {
+	id         int64
+	deviceSn   string
+	start, end time.Time
+}
+
+func NewBackfiller(app *App) *Backfiller {
+	return &Backfiller{app: app}
+}
+
+// Start records a job per device and works through them in the background
+func (b *Backfiller) Start(devices []string, start, end time.Time) (BackfillStatus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.running {
+		return b.status, ErrBackfillRunning
+	}
+	var jobs []backfillJob
+	for _, deviceSn := range devices {
+		result, err := b.app.DB.Exec("INSERT INTO backfill_jobs (device_sn, start_day, end_day) VALUES (?, ?, ?)",
+			deviceSn, start.Format(backfillDateLayout), end.Format(backfillDateLayout))
+		if err != nil {
+			return b.status, fmt.Errorf("error recording backfill job: %w", err)
+		}
+		jobID, err := result.LastInsertId()
+		if err != nil {
+			return b.status, fmt.Errorf("error reading backfill job id: %w", err)
+		}
+		jobs = append(jobs, backfillJob{id: jobID, deviceSn: deviceSn, start: start, end: end})
+	}
+
+	b.launch(jobs)
+	return b.status, nil
+}
+
+// ResumePending restarts any jobs left running by a previous process
+func (b *Backfiller) ResumePending() error {
+	rows, err := b.app.DB.Query("SELECT id, device_sn, start_day, end_day FROM backfill_jobs WHERE status = 'running' ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error looking for interrupted backfills: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []backfillJob
+	for rows.Next() {
+		var job backfillJob
+		var startStr, endStr string
+		if err := rows.Scan(&job.id, &job.deviceSn, &startStr, &endStr); err != nil {
+			return fmt.Errorf("error scanning backfill job: %w", err)
+		}
+		if job.start, err = time.ParseInLocation(backfillDateLayout, startStr, plantLocation); err != nil {
+			return fmt.Errorf("invalid start day on backfill job %d: %w", job.id, err)
+		}
+		if job.end, err = time.ParseInLocation(backfillDateLayout, endStr, plantLocation); err != nil {
+			return fmt.Errorf("invalid end day on backfill job %d: %w", job.id, err)
+		}
+		fmt.Printf("Resuming interrupted backfill job %d for %s (%s to %s)\n", job.id, job.deviceSn, startStr, endStr)
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating backfill jobs: %w", err)
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.launch(jobs)
+	return nil
+}
+
+// launch works through jobs in order on a background goroutine; b.mu must be held
+func (b *Backfiller) launch(jobs []backfillJob) {
+	b.running = true
+	b.status = BackfillStatus{Running: true, JobsTotal: len(jobs)}
+
+	go func() {
+		for i, job := range jobs {
+			b.runJob(job, jobs[i+1:])
+		}
+
+		b.mu.Lock()
+		b.running = false
+		b.status.Running = false
+		b.mu.Unlock()
+	}()
+}
+
+func (b *Backfiller) runJob(job backfillJob, queued []backfillJob) {
+	startedAt := time.Now()
+	b.mu.Lock()
+	b.status = BackfillStatus{
+		JobID:     job.id,
+		Running:   true,
+		DeviceSN:  job.deviceSn,
+		Start:     job.start.Format(backfillDateLayout),
+		End:       job.end.Format(backfillDateLayout),
+		StartedAt: &startedAt,
+		JobsTotal: b.status.JobsTotal,
+		JobsDone:  b.status.JobsDone,
+	}
+	for _, next := range queued {
+		b.status.Queued = append(b.status.Queued, next.deviceSn)
+	}
+	b.mu.Unlock()
+
+	final, err := RunBackfill(context.Background(), b.app, job.deviceSn, job.start, job.end, func(progress BackfillStatus) {
+		b.mu.Lock()
+		b.status.CurrentDay = progress.CurrentDay
+		b.status.DaysTotal = progress.DaysTotal
+		b.status.DaysDone = progress.DaysDone
+		b.status.DaysSkipped = progress.DaysSkipped
+		b.status.Rows = progress.Rows
+		b.mu.Unlock()
+	})
+
+	jobStatus, jobError := "completed", ""
+	if err != nil {
+		fmt.Println("Backfill failed:", err)
+		jobStatus, jobError = "failed", err.Error()
+	} else {
+		fmt.Printf("Backfill of %s from %s to %s complete: %d days, %d rows\n", job.deviceSn, final.Start, final.End, final.DaysDone, final.Rows)
+	}
+	if _, dbErr := b.app.DB.Exec("UPDATE backfill_jobs SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?", jobStatus, jobError, job.id); dbErr != nil {
+		fmt.Println("Error recording backfill job outcome:", dbErr)
+	}
+
+	finishedAt := time.Now()
+	b.mu.Lock()
+	b.status.JobsDone++
+	b.status.CurrentDay = final.CurrentDay
+	b.status.FinishedAt = &finishedAt
+	b.status.Error = jobError
+	b.mu.Unlock()
+}
+
+// Status returns the current (or last) job's progress
+func (b *Backfiller) Status() BackfillStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+type BackfillRequest struct {
+	Start    string `json:"start" binding:"required"`
+	End      string `json:"end" binding:"required"`
+	DeviceSN string `json:"deviceSn"`
+}
+
+func StartBackfillHandler(b *Backfiller) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input BackfillRequest
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		start, end, err := parseBackfillRange(input.Start, input.End)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		//no device given means every configured device
+		devices := b.app.Devices
+		if input.DeviceSN != "" {
+			if !b.app.HasDevice(input.DeviceSN) {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown device %s", input.DeviceSN)})
+				return
+			}
+			devices = []string{input.DeviceSN}
+		}
+
+		status, err := b.Start(devices, start, end)
+		if errors.Is(err, ErrBackfillRunning) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": status})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to start backfill: %v", err)})
+			return
+		}
+		c.JSON(http.StatusAccepted, status)
+	}
+}
+
+func BackfillStatusHandler(b *Backfiller) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, b.Status())
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cnkei/gospline"
@@ -20,7 +20,9 @@ type BatteryCalibrationInput struct {
 	Percentage int     `json:"percentage" binding:"required"`
 }
 
-func CalibrateBatteryHandler(db *sql.DB) gin.HandlerFunc {
+// CalibrateBatteryHandler adds a calibration point and starts re-deriving the stored battery
+// percentages with it in the background
+func CalibrateBatteryHandler(store Store, recalibrator *Recalibrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var input BatteryCalibrationInput
 
@@ -29,24 +31,14 @@ func CalibrateBatteryHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		err := createBatteryTable(db) //create table if it doesn't exist
-		if err != nil {
-			fmt.Println("Error creating data table:", err)
-			return
-		}
-
-		_, err = db.Exec(
-			"INSERT INTO battery_calibration (voltage, percentage) VALUES (?, ?)",
-			input.Voltage,
-			input.Percentage,
-		)
-
+		err := store.AddCalibration(input.Voltage, input.Percentage)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save calibration data: %v", err)})
 			return
 		}
+		recalibrator.Start()
 
-		records, err := GetCalibrationDataHandler(db)
+		records, err := store.Calibrations()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching calibration data from database"})
 			return
@@ -55,7 +47,9 @@ func CalibrateBatteryHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-func UpdateCalibrationDataHandler(db *sql.DB) gin.HandlerFunc {
+// UpdateCalibrationDataHandler changes a calibration point and starts re-deriving the stored
+// battery percentages in the background
+func UpdateCalibrationDataHandler(store Store, recalibrator *Recalibrator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		idStr := c.Param("id") //get id from url path
 		id, err := strconv.Atoi(idStr)
@@ -73,31 +67,18 @@ func UpdateCalibrationDataHandler(db *sql.DB) gin.HandlerFunc {
 		//test input log
 		log.Printf("Received PUT request for ID: %d, Voltage: %f, Percentage: %d", id, input.Voltage, input.Percentage)
 
-		result, err := db.Exec(
-			"UPDATE battery_calibration SET voltage = ?, percentage = ? WHERE id = ?",
-			input.Voltage,
-			input.Percentage,
-			id,
-		)
-
+		rowsAffected, err := store.UpdateCalibration(id, input.Voltage, input.Percentage)
 		if err != nil {
 			log.Printf("Error updating calibration data: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update calibration data"})
 			return
 		}
-
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			log.Printf("Error getting rows affected after UPDATE: %v", err)
-		} else {
-			log.Printf("UPDATE query executed, rows affected: %d", rowsAffected)
-
+		log.Printf("UPDATE query executed, rows affected: %d", rowsAffected)
+		if rowsAffected > 0 {
+			recalibrator.Start()
 		}
 
-		var updatedRecord CalibrationRecord
-		err = db.QueryRow("SELECT id, voltage, percentage FROM battery_calibration WHERE id = ?", id).Scan(
-			&updatedRecord.ID, &updatedRecord.Voltage, &updatedRecord.Percentage,
-		)
+		updatedRecord, err := store.Calibration(id)
 		if err != nil {
 			log.Printf("Error fetching update calibration data: %v", err)
 			c.JSON(http.StatusOK, gin.H{"message": "Calinration record updated successfully, but failed to fetch the updated record."})
@@ -110,21 +91,82 @@ func UpdateCalibrationDataHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-// createDataTable create device data
-func createBatteryTable(db *sql.DB) error {
-	_, err := db.Exec(`
-			CREATE TABLE IF NOT EXISTS battery_calibration (
-					id INTEGER PRIMARY KEY AUTOINCREMENT,
-					voltage REAL NOT NULL,
-					percentage INTEGER NOT NULL,
-					timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-					)	
-	`)
-	if err != nil {
-		fmt.Printf("error creating battery table: %v ---\n", err)
-		return fmt.Errorf("error creating table: %w", err)
+// Recalibrator runs Recalibrate in the background after calibration changes, so a request
+// doesn't wait on rewriting the whole history. A change arriving while a run is in progress
+// queues one more run, which picks up every change made in the meantime.
+type Recalibrator struct {
+	store Store
+	opts  EnergyOptions
+
+	mu      sync.Mutex
+	pending bool
+	status  RecalibrationStatus
+}
+
+// RecalibrationStatus is reported by GET /api/calibration_data/recalibration
+type RecalibrationStatus struct {
+	Running    bool       `json:"running"`
+	Queued     bool       `json:"queued"`
+	LastStart  *time.Time `json:"lastStart,omitempty"`
+	LastFinish *time.Time `json:"lastFinish,omitempty"`
+	Updated    int        `json:"updated"` // samples changed by the last run
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+func NewRecalibrator(store Store, opts EnergyOptions) *Recalibrator {
+	return &Recalibrator{store: store, opts: opts}
+}
+
+// Start begins a run, or queues one behind the run in progress
+func (r *Recalibrator) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.Running {
+		r.pending = true
+		return
 	}
-	return nil
+	r.status.Running = true
+	go r.run()
+}
+
+func (r *Recalibrator) run() {
+	for {
+		started := time.Now()
+		r.mu.Lock()
+		r.pending = false
+		r.status.LastStart = &started
+		r.mu.Unlock()
+
+		updated, err := Recalibrate(r.store, r.opts)
+		if err != nil {
+			log.Printf("Error re-deriving battery percentages: %v; run `inverter-api recalibrate` to retry", err)
+		} else {
+			log.Printf("Re-derived battery percentage of %d stored samples", updated)
+		}
+
+		finished := time.Now()
+		r.mu.Lock()
+		r.status.LastFinish = &finished
+		r.status.Updated = updated
+		r.status.LastError = ""
+		if err != nil {
+			r.status.LastError = err.Error()
+		}
+		if !r.pending {
+			r.status.Running = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Recalibrator) Status() RecalibrationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	status.Queued = r.pending
+	return status
 }
 
 type CalibrationRecord struct {
@@ -134,84 +176,86 @@ type CalibrationRecord struct {
 	Timestamp  time.Time `json:"timestamp"`
 }
 
-func GetCalibrationDataHandler(db *sql.DB) ([]CalibrationRecord, error) {
-	rows, err := db.Query("SELECT id, voltage, percentage, timestamp FROM battery_calibration")
+// AddCalibration stores a new calibration point
+func (s *sqlStore) AddCalibration(voltage float64, percentage int) error {
+	_, err := s.db.Exec(
+		s.bind("INSERT INTO battery_calibration (voltage, percentage) VALUES (?, ?)"),
+		voltage,
+		percentage,
+	)
 	if err != nil {
-		fmt.Println("Error querying calibration data:", err)
-		//c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch calibration data"})
-		return nil, fmt.Errorf("error querying calibration data: %w", err)
+		return fmt.Errorf("error inserting calibration data: %w", err)
 	}
-	defer rows.Close()
+	return nil
+}
 
-	var records []CalibrationRecord
-	for rows.Next() {
-		var record CalibrationRecord
-		if err := rows.Scan(&record.ID, &record.Voltage, &record.Percentage, &record.Timestamp); err != nil {
-			fmt.Println("Error scanning calibration data row:", err)
-			//c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read calibration data"})
-			return nil, fmt.Errorf("error scanning calibration data row: %w", err)
-		}
-		records = append(records, record)
+func (s *sqlStore) UpdateCalibration(id int, voltage float64, percentage int) (int64, error) {
+	result, err := s.db.Exec(
+		s.bind("UPDATE battery_calibration SET voltage = ?, percentage = ? WHERE id = ?"),
+		voltage,
+		percentage,
+		id,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error updating calibration data: %w", err)
 	}
-
-	if err := rows.Err(); err != nil {
-		fmt.Println("Error during rows iteration:", err)
-		//c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process calibration data"})
-		return nil, fmt.Errorf("error during rows iteration: %w", err)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected after UPDATE: %w", err)
 	}
+	return rowsAffected, nil
+}
 
-	return records, nil
+func (s *sqlStore) Calibration(id int) (CalibrationRecord, error) {
+	var record CalibrationRecord
+	err := s.db.QueryRow(s.bind("SELECT id, voltage, percentage, timestamp FROM battery_calibration WHERE id = ?"), id).Scan(
+		&record.ID, &record.Voltage, &record.Percentage, &record.Timestamp,
+	)
+	if err != nil {
+		return CalibrationRecord{}, fmt.Errorf("error fetching calibration record %d: %w", id, err)
+	}
+	return record, nil
 }
 
-func GetCalibrationHistory(db *sql.DB) ([]CalibrationRecord, error) {
-	rows, err := db.Query("SELECT id, voltage, percentage FROM battery_calibration")
+func (s *sqlStore) Calibrations() ([]CalibrationRecord, error) {
+	rows, err := s.db.Query("SELECT id, voltage, percentage, timestamp FROM battery_calibration ORDER BY id")
 	if err != nil {
-		return nil, fmt.Errorf("error querying calibration history: %w", err)
+		return nil, fmt.Errorf("error querying calibration data: %w", err)
 	}
 	defer rows.Close()
 
 	var records []CalibrationRecord
 	for rows.Next() {
 		var record CalibrationRecord
-		if err := rows.Scan(&record.ID, &record.Voltage, &record.Percentage); err != nil {
-			return nil, fmt.Errorf("error scanning calibration history: %w", err)
+		if err := rows.Scan(&record.ID, &record.Voltage, &record.Percentage, &record.Timestamp); err != nil {
+			return nil, fmt.Errorf("error scanning calibration data row: %w", err)
 		}
 		records = append(records, record)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating through device history rows: %w", err)
+		return nil, fmt.Errorf("error during rows iteration: %w", err)
 	}
 
 	return records, nil
 }
 
-func CalibrateBatteryPercentage(db *sql.DB, currentVoltage float64) (int, error) {
-	rows, err := db.Query("SELECT voltage, percentage FROM battery_calibration")
+func CalibrateBatteryPercentage(calibrations CalibrationStore, currentVoltage float64) (int, error) {
+	records, err := calibrations.Calibrations()
 	if err != nil {
 		log.Printf("Error querying calibration data from database: %v", err)
 		return 0, err
 	}
-	defer rows.Close()
+	return calibratedPercentage(records, currentVoltage), nil
+}
 
+// calibratedPercentage maps a battery voltage to a percentage using the calibration points in records
+func calibratedPercentage(records []CalibrationRecord, currentVoltage float64) int {
 	var voltages []float64
 	var percentages []float64
-
-	for rows.Next() {
-		var voltage float64
-		var percentage int
-
-		if err := rows.Scan(&voltage, &percentage); err != nil {
-			log.Printf("Error scanning calibration data row: %v", err)
-			return 0, err
-		}
-		voltages = append(voltages, voltage)
-		percentages = append(percentages, float64(percentage))
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error during rows iteration: %v", err)
-		return 0, err
+	for _, record := range records {
+		voltages = append(voltages, record.Voltage)
+		percentages = append(percentages, float64(record.Percentage))
 	}
 
 	var calibratedPercentage int
@@ -234,8 +278,30 @@ func CalibrateBatteryPercentage(db *sql.DB, currentVoltage float64) (int, error)
 		calibratedPercentage = 100
 	}
 
-	return calibratedPercentage, nil
+	return calibratedPercentage
+}
 
+// Recalibrate re-derives battery_percentage of the stored samples from the current calibration
+// points and recomputes the summaries of the days that changed. It returns the samples updated.
+func Recalibrate(store Store, opts EnergyOptions) (int, error) {
+	records, err := store.Calibrations()
+	if err != nil {
+		return 0, err
+	}
+	updated, days, err := store.UpdateBatteryPercentages(func(voltage float64) int {
+		return calibratedPercentage(records, voltage)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for deviceSn, deviceDays := range days {
+		for _, day := range deviceDays {
+			if err := RecomputeDailySummary(store, opts, deviceSn, day); err != nil {
+				return updated, err
+			}
+		}
+	}
+	return updated, nil
 }
 
 func polynomialRegression(voltages, percentages []float64, n int, currentVoltage float64) int {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecalibratorUpdatesHistoryInBatches(t *testing.T) {
+	store := newTestStore(t)
+	opts := EnergyOptions{MaxGap: 15 * time.Minute}
+
+	//more samples than one batch, spread over two days, stored with the default curve
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, plantLocation)
+	var records []DeviceData
+	for i := range recalibrateBatchSize + 500 {
+		at := start.Add(time.Duration(i) * time.Minute)
+		voltage := 50 + float64(i%40)/10
+		records = append(records, DeviceData{DeviceSn: "SN1", DeviceDataTime: at.Format("2006-01-02 15:04:05"), EmsVoltage: fmt.Sprint(voltage)})
+	}
+	if err := store.SaveHistory(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateDailySummaries(store, opts, records); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddCalibration(50, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddCalibration(54, 90); err != nil {
+		t.Fatal(err)
+	}
+	recalibrator := NewRecalibrator(store, opts)
+	recalibrator.Start()
+	deadline := time.Now().Add(10 * time.Second)
+	for recalibrator.Status().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("recalibration still running after 10s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := recalibrator.Status(); status.LastError != "" || status.Updated == 0 {
+		t.Fatalf("status %+v, want samples updated without error", status)
+	}
+
+	calibration, err := store.Calibrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stale int
+	rows, err := store.db.Query("SELECT battery_voltage_v, battery_percentage FROM device_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var total int
+	for rows.Next() {
+		var voltage float64
+		var percentage int
+		if err := rows.Scan(&voltage, &percentage); err != nil {
+			t.Fatal(err)
+		}
+		total++
+		if percentage != calibratedPercentage(calibration, voltage) {
+			stale++
+		}
+	}
+	if total != len(records) || stale != 0 {
+		t.Errorf("%d of %d samples have a stale percentage, want none of %d", stale, total, len(records))
+	}
+
+	want := float64(calibratedPercentage(calibration, 53.9))
+	for _, day := range []string{"2024-01-02", "2024-01-03"} {
+		summaries, err := store.DailySummaries("SN1", day, day)
+		if err != nil || len(summaries) != 1 {
+			t.Fatalf("summaries on %s: %v, %v", day, summaries, err)
+		}
+		if max := summaries[0].BatteryPercentageMax; max == nil || *max != want {
+			t.Errorf("battery percentage max on %s = %v, want %v from the new calibration", day, max, want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+
+	"github.com/joho/godotenv"
+)
+
+// runCommand dispatches a CLI subcommand, e.g. `inverter-api backfill -start 2025-01-01 -end 2025-01-31`
+func runCommand(app *App, name string, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch name {
+	case "backfill":
+		return backfillCommand(ctx, app, args)
+	case "reprocess":
+		return reprocessCommand(ctx, app, args)
+	case "summarize":
+		return summarizeCommand(ctx, app, args)
+	case "recalibrate":
+		return recalibrateCommand(app)
+	default:
+		return fmt.Errorf("unknown command %q (available: backfill, reprocess, summarize, recalibrate, migrate)", name)
+	}
+}
+
+func backfillCommand(ctx context.Context, app *App, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	startStr := flags.String("start", "", "first day to fetch, YYYY-MM-DD")
+	endStr := flags.String("end", "", "last day to fetch (inclusive), YYYY-MM-DD")
+	deviceSn := flags.String("device", "", "device serial number (default: every configured device)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *startStr == "" || *endStr == "" {
+		return fmt.Errorf("backfill requires -start and -end")
+	}
+
+	start, end, err := parseBackfillRange(*startStr, *endStr)
+	if err != nil {
+		return err
+	}
+
+	devices := []string{*deviceSn}
+	if *deviceSn == "" {
+		if err := app.ensureDevices(); err != nil {
+			return err
+		}
+		devices = app.Devices
+	}
+
+	for _, sn := range devices {
+		status, err := RunBackfill(ctx, app, sn, start, end, func(progress BackfillStatus) {
+			fmt.Printf("%s %s: day %d/%d done (%d skipped), %d rows\n", sn, progress.CurrentDay, progress.DaysDone, progress.DaysTotal, progress.DaysSkipped, progress.Rows)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backfill of %s complete: %d days, %d rows\n", sn, status.DaysDone, status.Rows)
+	}
+	return nil
+}
+
+// reprocessCommand re-derives the archived samples in device_data from the raw response archive.
+// With -from-scratch the archived devices' history is deleted first and rebuilt from the archive alone.
+func reprocessCommand(ctx context.Context, app *App, args []string) error {
+	flags := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	fromScratch := flags.Bool("from-scratch", false, "delete the archived devices' samples, summaries and history events before replaying")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stored, err := ReprocessArchive(ctx, app.DB, app.Store, app.Energy, *fromScratch, func(done, total, rows int) {
+		fmt.Printf("Replayed %d/%d archived responses, %d rows\n", done, total, rows)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reprocess complete: %d rows\n", stored)
+	return nil
+}
+
+// summarizeCommand recomputes daily_summary from the stored samples, e.g. for days that were
+// ingested before summaries existed
+func summarizeCommand(ctx context.Context, app *App, args []string) error {
+	flags := flag.NewFlagSet("summarize", flag.ContinueOnError)
+	startStr := flags.String("start", "", "first day to summarize, YYYY-MM-DD")
+	endStr := flags.String("end", "", "last day to summarize (inclusive), YYYY-MM-DD")
+	deviceSn := flags.String("device", "", "device serial number (default: every configured or known device)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *startStr == "" || *endStr == "" {
+		return fmt.Errorf("summarize requires -start and -end")
+	}
+
+	start, end, err := parseBackfillRange(*startStr, *endStr)
+	if err != nil {
+		return err
+	}
+
+	//without a configured list, summarize the devices discovery saved earlier rather than asking the API
+	devices := app.Devices
+	if *deviceSn != "" {
+		devices = []string{*deviceSn}
+	} else if len(devices) == 0 {
+		if devices, err = knownDeviceSerials(app.DB); err != nil {
+			return err
+		}
+		if len(devices) == 0 {
+			return fmt.Errorf("no devices configured or previously discovered, pass -device")
+		}
+	}
+
+	for _, sn := range devices {
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := RecomputeDailySummary(app.Store, app.Energy, sn, day.Format(backfillDateLayout)); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Summaries of %s from %s to %s recomputed\n", sn, *startStr, *endStr)
+	}
+	return nil
+}
+
+// recalibrateCommand re-derives the stored battery percentages from the current calibration
+// points and recomputes the affected summaries. The calibration endpoints do this on every
+// change; the command is for calibrations edited directly in the database, or a failed run.
+func recalibrateCommand(app *App) error {
+	updated, err := Recalibrate(app.Store, app.Energy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recalibration complete: %d samples updated\n", updated)
+	return nil
+}
+
+// migrateCommand runs `inverter-api migrate [up|down -steps N|status] [-db sqlite|postgres|timescale]`,
+// postgres and timescale being the history store at DATABASE_URL. It only needs the
+// database, so it runs without credentials or a network connection and before NewApp,
+// which would otherwise migrate up on its own.
+func migrateCommand(args []string) error {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error loading .env file: %w", err)
+	}
+	if err := setPlantTimezone(os.Getenv("PLANT_TIMEZONE")); err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "number of migrations to revert (down only)")
+	dialect := flags.String("db", dialectSQLite, "database to migrate: sqlite, postgres or timescale")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var db *sql.DB
+	var err error
+	switch *dialect {
+	case dialectSQLite:
+		db, err = sql.Open("sqlite3", dbFileName)
+	case dialectPostgres, dialectTimescale:
+		if os.Getenv("DATABASE_URL") == "" {
+			return fmt.Errorf("DATABASE_URL must be set to migrate %s", *dialect)
+		}
+		db, err = sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	default:
+		return fmt.Errorf("unknown database %q (expected sqlite, postgres or timescale)", *dialect)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	defer db.Close()
+
+	switch action {
+	case "up":
+		applied, err := MigrateUp(db, *dialect)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Database up to date, %d migrations applied\n", applied)
+	case "down":
+		if *steps <= 0 {
+			return fmt.Errorf("-steps must be positive")
+		}
+		reverted, err := MigrateDown(db, *dialect, *steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migrations reverted\n", reverted)
+	case "status":
+		statuses, err := GetMigrationStatus(db, *dialect)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q (available: up, down, status)", action)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a Go duration (e.g. "5m", "1h30m") from the environment, falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		fmt.Printf("Warning: invalid %s=%q, using default %s\n", name, value, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		fmt.Printf("Warning: invalid %s=%q, using default %d\n", name, value, def)
+		return def
+	}
+	return n
+}
+
+// envFloat reads a non-negative float from the environment, falling back to def
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		fmt.Printf("Warning: invalid %s=%q, using default %g\n", name, value, def)
+		return def
+	}
+	return f
+}
@@ -3,92 +3,567 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"strconv"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 
 type DbData struct {
 	ID                int
-	TimeStamp         string
+	DeviceSn          string
+	TimeStamp         string // RFC 3339 in the plant's time zone
+	LocalTime         string // data_time as the device reported it
 	PvTotalPower      string
 	EmsPower          string
 	EmsVoltage        string
 	LoadPower         string
 	BatteryPercentage string
+
+	ts int64 // data_ts, for cursors
+}
+
+func (d DbData) cursor() HistoryCursor {
+	return HistoryCursor{Ts: d.ts, ID: int64(d.ID)}
 }
 
-func GetAllDeviceHistory(db *sql.DB) ([]DbData, error) {
-	rows, err := db.Query("SELECT id, data_time, pv_input_power_w, battery_power_w, battery_voltage_v, load_power_w, battery_percentage FROM device_data")
+const historyColumns = "id, device_sn, data_time, data_ts, pv_input_power_w, battery_power_w, battery_voltage_v, load_power_w, battery_percentage"
+
+// AllHistory returns every stored sample in timeRange, restricted to one device when deviceSn is set,
+// in the same (device time, id) order HistoryPage pages through
+func (s *sqlStore) AllHistory(deviceSn string, timeRange TimeRange) ([]DbData, error) {
+	query := "SELECT " + historyColumns + " FROM device_data"
+	conditions, args := s.timeConditions(timeRange)
+	if deviceSn != "" {
+		conditions = append(conditions, "device_sn = ?")
+		args = append(args, deviceSn)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + s.timeColumn() + ", id"
+
+	rows, err := s.db.Query(s.bind(query), args...)
 	if err != nil {
 		return nil, fmt.Errorf("error querying device history: %w", err)
 	}
 	defer rows.Close()
+	return scanHistory(rows)
+}
 
-	var history []DbData
-	for rows.Next() {
-		var data DbData
-		if err := rows.Scan(&data.ID, &data.TimeStamp, &data.PvTotalPower, &data.EmsPower, &data.EmsVoltage, &data.LoadPower, &data.BatteryPercentage); err != nil {
-			return nil, fmt.Errorf("error scanning device history: %w", err)
+// HistoryCursor marks a row's position in (device time, id) order
+type HistoryCursor struct {
+	Ts int64 // data_ts of the row
+	ID int64
+}
+
+// HistoryQuery selects one page of history. At most one of After and Before is set:
+// After continues past a row in the query's order, Before returns the page ending just before it.
+type HistoryQuery struct {
+	DeviceSn   string
+	Range      TimeRange
+	Limit      int
+	Descending bool
+	After      *HistoryCursor
+	Before     *HistoryCursor
+	Offset     int // rows to skip, for deprecated pageNum paging; ignored with a cursor
+}
+
+// HistoryPage is one page of history with the cursors either side of it
+type HistoryPage struct {
+	Rows  []DbData
+	Total int            // rows matching the filters across all pages
+	Next  *HistoryCursor // nil on the last page
+	Prev  *HistoryCursor // nil on the first page
+}
+
+// HistoryPage fetches one page using keyset pagination on (device time, id), so deep pages
+// cost the same as the first. Rows whose time couldn't be parsed have no place in the order
+// and are left out.
+func (s *sqlStore) HistoryPage(q HistoryQuery) (HistoryPage, error) {
+	timeColumn, cursorTime := s.timeColumn(), "?"
+	if s.dialect == dialectTimescale {
+		cursorTime = "to_timestamp(?)"
+	}
+
+	conditions, args := s.timeConditions(q.Range)
+	conditions = append(conditions, timeColumn+" IS NOT NULL")
+	if q.DeviceSn != "" {
+		conditions = append(conditions, "device_sn = ?")
+		args = append(args, q.DeviceSn)
+	}
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	var page HistoryPage
+	if err := s.db.QueryRow(s.bind("SELECT COUNT(*) FROM device_data"+where), args...).Scan(&page.Total); err != nil {
+		return page, fmt.Errorf("error counting device history: %w", err)
+	}
+
+	//a Before page is read backwards from the cursor and flipped afterwards
+	forward := q.Before == nil
+	ascending := q.Descending != forward
+	cursor, comparison := q.After, ">"
+	if !forward {
+		cursor = q.Before
+	}
+	if !ascending {
+		comparison = "<"
+	}
+	offset := q.Offset
+	if cursor != nil {
+		where += " AND (" + timeColumn + ", id) " + comparison + " (" + cursorTime + ", ?)"
+		args = append(args, cursor.Ts, cursor.ID)
+		offset = 0
+	}
+	direction := "ASC"
+	if !ascending {
+		direction = "DESC"
+	}
+
+	//one extra row tells us whether there is another page
+	query := "SELECT " + historyColumns + " FROM device_data" + where +
+		" ORDER BY " + timeColumn + " " + direction + ", id " + direction + " LIMIT ? OFFSET ?"
+	args = append(args, q.Limit+1, offset)
+
+	rows, err := s.db.Query(s.bind(query), args...)
+	if err != nil {
+		return page, fmt.Errorf("error querying device history: %w", err)
+	}
+	defer rows.Close()
+	history, err := scanHistory(rows)
+	if err != nil {
+		return page, err
+	}
+
+	more := len(history) > q.Limit
+	if more {
+		history = history[:q.Limit]
+	}
+	if !forward {
+		slices.Reverse(history)
+	}
+	if history == nil {
+		history = []DbData{}
+	}
+	page.Rows = history
+	if len(history) == 0 {
+		return page, nil
+	}
+
+	first, last := history[0].cursor(), history[len(history)-1].cursor()
+	if forward {
+		if more {
+			page.Next = &last
 		}
-		history = append(history, data)
+		if q.After != nil || offset > 0 {
+			page.Prev = &first
+		}
+	} else {
+		if more {
+			page.Prev = &first
+		}
+		page.Next = &last
+	}
+	return page, nil
+}
+
+// numericColumns are the device_data columns that can be read as series
+var numericColumns = []string{
+	"pv_input_power_w", "battery_power_w", "battery_voltage_v", "load_power_w", "battery_percentage",
+	"ac_output_voltage", "ac_output_current", "ac_output_frequency_hz",
+	"pv1_voltage_v", "pv1_current_a", "pv2_voltage_v", "pv2_current_a",
+	"grid_voltage_v", "grid_current_a", "grid_frequency_hz",
+	"battery_current_a", "inverter_temp_c", "dc_temp_c",
+}
+
+// Sample is one row of selected numeric columns, in the order they were asked for
+type Sample struct {
+	DeviceSn string
+	Ts       int64 // data_ts
+	Values   []sql.NullFloat64
+}
+
+// HistorySamples returns the given numeric columns for every sample in timeRange, ordered by
+// device then time. Rows whose time couldn't be parsed are left out.
+func (s *sqlStore) HistorySamples(deviceSn string, timeRange TimeRange, columns []string) ([]Sample, error) {
+	for _, column := range columns {
+		if !slices.Contains(numericColumns, column) {
+			return nil, fmt.Errorf("unknown numeric column %q", column)
+		}
+	}
+
+	conditions, args := s.timeConditions(timeRange)
+	conditions = append(conditions, "data_ts IS NOT NULL")
+	if deviceSn != "" {
+		conditions = append(conditions, "device_sn = ?")
+		args = append(args, deviceSn)
+	}
+	query := "SELECT device_sn, data_ts"
+	for _, column := range columns {
+		query += ", " + column
+	}
+	query += " FROM device_data WHERE " + strings.Join(conditions, " AND ") + " ORDER BY device_sn, data_ts, id"
+
+	rows, err := s.db.Query(s.bind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying device samples: %w", err)
 	}
+	defer rows.Close()
 
+	var samples []Sample
+	for rows.Next() {
+		sample := Sample{Values: make([]sql.NullFloat64, len(columns))}
+		dest := []interface{}{&sample.DeviceSn, &sample.Ts}
+		for i := range sample.Values {
+			dest = append(dest, &sample.Values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("error scanning device sample: %w", err)
+		}
+		samples = append(samples, sample)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating through device history rows: %w", err)
+		return nil, fmt.Errorf("error iterating through device samples: %w", err)
 	}
+	return samples, nil
+}
 
-	return history, nil
+// HistoryBuckets groups the samples in q.Range into buckets and reduces each of q.Fields with
+// q.Fn in the database: integer division of data_ts on SQLite and PostgreSQL, time_bucket on
+// TimescaleDB. For last, each field's value comes from the latest sample in the bucket that has it.
+// On TimescaleDB, whole hourly and daily buckets the rollup views cover are read from those.
+func (s *sqlStore) HistoryBuckets(q BucketQuery) ([]Bucket, error) {
+	for _, column := range q.Fields {
+		if !slices.Contains(numericColumns, column) {
+			return nil, fmt.Errorf("unknown numeric column %q", column)
+		}
+	}
+	if q.Range.From.IsZero() || q.Range.To.IsZero() || q.Range.From.Before(q.Origin) {
+		return nil, fmt.Errorf("bucket range must be bounded and start at or after its origin")
+	}
+	if view, ok := s.rollupView(q); ok {
+		return s.rollupBuckets(q, view)
+	}
+	return s.sampleBuckets(q)
 }
 
-// fetch device history data with pagination and date
-func GetDeviceHistory(db *sql.DB, dateStr, pageNumStr, pageSizeStr string) ([]DbData, error) {
-	pageSize := 10
-	pageNum := 1
+// rollups are the TimescaleDB continuous aggregates by bucket width, and rollupColumns the
+// reductions they keep of each column, as <column>_<fn>
+var (
+	rollups       = map[time.Duration]string{time.Hour: "device_data_hourly", 24 * time.Hour: "device_data_daily"}
+	rollupColumns = map[string][]string{
+		"pv_input_power_w":   {"avg", "max"},
+		"battery_power_w":    {"avg"},
+		"battery_voltage_v":  {"avg", "min", "max"},
+		"load_power_w":       {"avg", "max"},
+		"battery_percentage": {"avg", "min", "max"},
+	}
+)
 
-	// Parse pageSize
-	if pageSizeStr != "" {
-		size, err := strconv.Atoi(pageSizeStr)
-		if err == nil && size > 0 {
-			pageSize = size
+// rollupView returns the continuous aggregate that can serve q: one whose UTC buckets line up
+// with q's and that keeps q.Fn of every field
+func (s *sqlStore) rollupView(q BucketQuery) (string, bool) {
+	view, ok := rollups[q.Interval]
+	if s.dialect != dialectTimescale || !ok || q.Origin.Unix()%int64(q.Interval/time.Second) != 0 {
+		return "", false
+	}
+	for _, column := range q.Fields {
+		if !slices.Contains(rollupColumns[column], q.Fn) {
+			return "", false
 		}
 	}
+	return view, true
+}
 
-	// Parse pageNum
-	if pageNumStr != "" {
-		num, err := strconv.Atoi(pageNumStr)
-		if err == nil && num > 0 {
-			pageNum = num
+// rollupBuckets reads the whole buckets in q.Range from view, and the partial ones at its edges
+// from the samples. An avg comes back as the rollup's average weighted by its sample count, so
+// Values[i]/Counts[i] is the same average as the view's.
+func (s *sqlStore) rollupBuckets(q BucketQuery, view string) ([]Bucket, error) {
+	whole := TimeRange{
+		From: q.Origin.Add(q.Range.From.Sub(q.Origin).Truncate(q.Interval)),
+		To:   q.Origin.Add(q.Range.To.Sub(q.Origin).Truncate(q.Interval)),
+	}
+	if whole.From.Before(q.Range.From) {
+		whole.From = whole.From.Add(q.Interval)
+	}
+	if !whole.From.Before(whole.To) {
+		return s.sampleBuckets(q)
+	}
+
+	var buckets []Bucket
+	for _, edge := range []TimeRange{{From: q.Range.From, To: whole.From}, {From: whole.To, To: q.Range.To}} {
+		if !edge.From.Before(edge.To) {
+			continue
+		}
+		edgeQuery := q
+		edgeQuery.Range = edge
+		edgeBuckets, err := s.sampleBuckets(edgeQuery)
+		if err != nil {
+			return nil, err
 		}
+		buckets = append(buckets, edgeBuckets...)
+	}
+
+	var reductions []string
+	for _, column := range q.Fields {
+		value := column + "_" + q.Fn
+		if q.Fn == "avg" {
+			reductions = append(reductions, fmt.Sprintf("%s * samples, CASE WHEN %s IS NULL THEN 0 ELSE samples END", value, value))
+		} else {
+			reductions = append(reductions, value)
+		}
+	}
+	query := "SELECT device_sn, CAST(EXTRACT(EPOCH FROM bucket) AS BIGINT), samples, " + strings.Join(reductions, ", ") +
+		" FROM " + view + " WHERE bucket >= ? AND bucket < ?"
+	args := []interface{}{whole.From, whole.To}
+	if q.DeviceSn != "" {
+		query += " AND device_sn = ?"
+		args = append(args, q.DeviceSn)
 	}
+	viewBuckets, err := s.scanBuckets(query+" ORDER BY device_sn, bucket", args, q)
+	if err != nil {
+		return nil, err
+	}
+	buckets = append(buckets, viewBuckets...)
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].DeviceSn != buckets[j].DeviceSn {
+			return buckets[i].DeviceSn < buckets[j].DeviceSn
+		}
+		return buckets[i].Start < buckets[j].Start
+	})
+	return buckets, nil
+}
 
-	//calculate OFFSET for pagination
-	offset := (pageNum - 1) * pageSize
+// RefreshRollups refreshes the TimescaleDB continuous aggregates over timeRange, widened to whole
+// UTC days so every bucket it touches is recomputed. Their policies only revisit the last few
+// days, so history written further back, by a backfill or a reprocess, needs this. It can't run
+// in a transaction. Other stores have no rollups.
+func (s *sqlStore) RefreshRollups(timeRange TimeRange) error {
+	if s.dialect != dialectTimescale {
+		return nil
+	}
+	var from, to interface{}
+	if !timeRange.From.IsZero() {
+		from = timeRange.From.UTC().Truncate(24 * time.Hour)
+	}
+	if !timeRange.To.IsZero() {
+		end := timeRange.To.UTC().Truncate(24 * time.Hour)
+		if end.Before(timeRange.To) {
+			end = end.Add(24 * time.Hour)
+		}
+		to = end
+	}
+	for _, view := range []string{rollups[time.Hour], rollups[24*time.Hour]} {
+		if _, err := s.db.Exec(s.bind("CALL refresh_continuous_aggregate('"+view+"', CAST(? AS TIMESTAMPTZ), CAST(? AS TIMESTAMPTZ))"), from, to); err != nil {
+			return fmt.Errorf("error refreshing %s: %w", view, err)
+		}
+	}
+	return nil
+}
 
-	// Construct the SQL query
-	query := `SELECT id, data_time, pv_input_power_w, battery_power_w, battery_voltage_v, load_power_w, battery_percentage FROM device_data`
-	var args []interface{}
+// sampleBuckets buckets and reduces the samples of device_data themselves
+func (s *sqlStore) sampleBuckets(q BucketQuery) ([]Bucket, error) {
+	//origin and width are whole seconds of our own, so they go into the SQL as literals
+	origin, width := q.Origin.Unix(), int64(q.Interval/time.Second)
+	timeColumn := s.timeColumn()
+	bucketExpr := fmt.Sprintf("(data_ts - %d) / %d * %d + %d", origin, width, width, origin)
+	if s.dialect == dialectTimescale {
+		bucketExpr = fmt.Sprintf("CAST(EXTRACT(EPOCH FROM time_bucket(INTERVAL '%d seconds', device_time, to_timestamp(%d))) AS BIGINT)", width, origin)
+	}
 
-	// Add date filtering if dateStr is provided
-	if dateStr != "" {
-		query += ` WHERE strftime('%Y-%m-%d', data_time) = ?`
-		args = append(args, dateStr)
+	conditions, args := s.timeConditions(q.Range)
+	conditions = append(conditions, "data_ts IS NOT NULL")
+	if q.DeviceSn != "" {
+		conditions = append(conditions, "device_sn = ?")
+		args = append(args, q.DeviceSn)
 	}
+	from := "SELECT device_sn, id, " + timeColumn + " AS t, " + bucketExpr + " AS bucket, " + strings.Join(q.Fields, ", ") +
+		" FROM device_data WHERE " + strings.Join(conditions, " AND ")
 
-	//add limit and offset for pagination
-	query += `LIMIT ? OFFSET ?`
-	args = append(args, pageSize, offset)
+	var reductions []string
+	if q.Fn == "last" {
+		//rank each field's rows in the bucket latest first, with the rows lacking it ranked apart
+		var ranks []string
+		for i, column := range q.Fields {
+			ranks = append(ranks, fmt.Sprintf("ROW_NUMBER() OVER (PARTITION BY device_sn, bucket, %s IS NULL ORDER BY t DESC, id DESC) AS rank%d", column, i))
+			reductions = append(reductions, fmt.Sprintf("MAX(CASE WHEN rank%d = 1 THEN %s END)", i, column))
+		}
+		from = "SELECT b.*, " + strings.Join(ranks, ", ") + " FROM (" + from + ") b"
+	}
+	for _, column := range q.Fields {
+		switch q.Fn {
+		case "avg":
+			reductions = append(reductions, "SUM("+column+"), COUNT("+column+")")
+		case "min", "max":
+			reductions = append(reductions, strings.ToUpper(q.Fn)+"("+column+")")
+		case "last":
+		default:
+			return nil, fmt.Errorf("unknown aggregate function %q", q.Fn)
+		}
+	}
+	query := "SELECT device_sn, bucket, COUNT(*), " + strings.Join(reductions, ", ") +
+		" FROM (" + from + ") r GROUP BY device_sn, bucket ORDER BY device_sn, bucket"
+	return s.scanBuckets(query, args, q)
+}
 
-	rows, err := db.Query(query, args...)
+// scanBuckets runs query, whose rows are a device, bucket start, sample count and then, for each
+// of q.Fields, its value and, for avg, the count of samples that had it
+func (s *sqlStore) scanBuckets(query string, args []interface{}, q BucketQuery) ([]Bucket, error) {
+	rows, err := s.db.Query(s.bind(query), args...)
 	if err != nil {
-		return nil, fmt.Errorf("error querying device history: %w", err)
+		return nil, fmt.Errorf("error querying history buckets: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []Bucket
+	for rows.Next() {
+		bucket := Bucket{Values: make([]sql.NullFloat64, len(q.Fields)), Counts: make([]int, len(q.Fields))}
+		dest := []interface{}{&bucket.DeviceSn, &bucket.Start, &bucket.Samples}
+		for i := range q.Fields {
+			dest = append(dest, &bucket.Values[i])
+			if q.Fn == "avg" {
+				dest = append(dest, &bucket.Counts[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("error scanning history bucket: %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating through history buckets: %w", err)
+	}
+	return buckets, nil
+}
+
+// recalibrateBatchSize is how many samples UpdateBatteryPercentages reads and rewrites at a time
+const recalibrateBatchSize = 1000
+
+// UpdateBatteryPercentages recomputes battery_percentage from battery_voltage_v for every sample
+// that has a voltage, writing only the rows whose percentage changes. Samples are walked in id
+// order a batch at a time, each batch committed on its own, so memory stays bounded however
+// much history there is.
+func (s *sqlStore) UpdateBatteryPercentages(percentage func(voltage float64) int) (int, map[string][]string, error) {
+	updated := 0
+	days := make(map[string][]string)
+	seen := make(map[[2]string]bool)
+	for afterID := int64(0); ; {
+		changes, lastID, err := s.batteryPercentageChanges(afterID, percentage)
+		if err != nil {
+			return updated, nil, err
+		}
+		if lastID == afterID {
+			return updated, days, nil
+		}
+		afterID = lastID
+
+		if err := s.writeBatteryPercentages(changes); err != nil {
+			return updated, nil, err
+		}
+		updated += len(changes)
+		for _, c := range changes {
+			if !c.ts.Valid {
+				continue
+			}
+			day := time.Unix(c.ts.Int64, 0).In(plantLocation).Format(backfillDateLayout)
+			if key := [2]string{c.deviceSn, day}; !seen[key] {
+				seen[key] = true
+				days[c.deviceSn] = append(days[c.deviceSn], day)
+			}
+		}
+	}
+}
+
+// batteryPercentageChange is a sample whose stored battery_percentage is out of date
+type batteryPercentageChange struct {
+	id         int64
+	deviceSn   string
+	ts         sql.NullInt64
+	percentage int
+}
+
+// batteryPercentageChanges reads the next batch of samples with a voltage after afterID and
+// returns those whose percentage changes, along with the last id read (afterID when none were)
+func (s *sqlStore) batteryPercentageChanges(afterID int64, percentage func(voltage float64) int) ([]batteryPercentageChange, int64, error) {
+	rows, err := s.db.Query(s.bind("SELECT id, device_sn, data_ts, battery_voltage_v, battery_percentage FROM device_data"+
+		" WHERE battery_voltage_v IS NOT NULL AND id > ? ORDER BY id LIMIT ?"), afterID, recalibrateBatchSize)
+	if err != nil {
+		return nil, afterID, fmt.Errorf("error querying battery voltages: %w", err)
 	}
 	defer rows.Close()
 
+	var changes []batteryPercentageChange
+	lastID := afterID
+	for rows.Next() {
+		var c batteryPercentageChange
+		var voltage float64
+		var current sql.NullInt64
+		if err := rows.Scan(&c.id, &c.deviceSn, &c.ts, &voltage, &current); err != nil {
+			return nil, afterID, fmt.Errorf("error scanning battery voltage: %w", err)
+		}
+		lastID = c.id
+		c.percentage = percentage(voltage)
+		if !current.Valid || current.Int64 != int64(c.percentage) {
+			changes = append(changes, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, afterID, fmt.Errorf("error iterating through battery voltages: %w", err)
+	}
+	return changes, lastID, nil
+}
+
+// writeBatteryPercentages stores one batch of changed percentages in a transaction
+func (s *sqlStore) writeBatteryPercentages(changes []batteryPercentageChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	//on TimescaleDB the time narrows each update to one chunk
+	query := "UPDATE device_data SET battery_percentage = ? WHERE id = ?"
+	if s.dialect == dialectTimescale {
+		query += " AND device_time = to_timestamp(?)"
+	}
+	stmt, err := tx.Prepare(s.bind(query))
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, c := range changes {
+		args := []interface{}{c.percentage, c.id}
+		if s.dialect == dialectTimescale {
+			args = append(args, c.ts.Int64)
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return fmt.Errorf("error updating battery percentage: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// scanHistory reads rows selected with historyColumns
+func scanHistory(rows *sql.Rows) ([]DbData, error) {
 	var history []DbData
 	for rows.Next() {
 		var data DbData
-		if err := rows.Scan(&data.ID, &data.TimeStamp, &data.PvTotalPower, &data.EmsPower, &data.EmsVoltage, &data.LoadPower, &data.BatteryPercentage); err != nil {
+		var dataTs sql.NullInt64
+		var pv, battery, voltage, load, percentage sql.NullString //NULL where the record lacked the metric
+		if err := rows.Scan(&data.ID, &data.DeviceSn, &data.LocalTime, &dataTs, &pv, &battery, &voltage, &load, &percentage); err != nil {
 			return nil, fmt.Errorf("error scanning device history row: %w", err)
 		}
+		data.PvTotalPower, data.EmsPower, data.EmsVoltage = pv.String, battery.String, voltage.String
+		data.LoadPower, data.BatteryPercentage = load.String, percentage.String
+		data.TimeStamp = formatTimestamp(dataTs, data.LocalTime)
+		data.ts = dataTs.Int64
 		history = append(history, data)
 	}
 
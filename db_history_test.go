@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a migrated SQLite store in a temporary directory
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := MigrateUp(db, dialectSQLite); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLiteStore(db)
+}
+
+func TestAllHistoryOrdersByDeviceTime(t *testing.T) {
+	store := newTestStore(t)
+	//a backfill stores an earlier day after the poller stored today
+	for _, dataTime := range []string{"2024-01-02 10:05:00", "2024-01-02 10:00:00", "2024-01-01 23:55:00"} {
+		if err := store.SaveHistory([]DeviceData{{DeviceSn: "SN1", DeviceDataTime: dataTime}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := store.AllHistory("SN1", TimeRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2024-01-01 23:55:00", "2024-01-02 10:00:00", "2024-01-02 10:05:00"}
+	if len(rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(rows), len(want))
+	}
+	for i, row := range rows {
+		if row.LocalTime != want[i] {
+			t.Errorf("row %d at %s, want %s", i, row.LocalTime, want[i])
+		}
+	}
+}
+
+func TestRollupView(t *testing.T) {
+	timescale := &sqlStore{dialect: dialectTimescale}
+	utcMidnight := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	india := time.Date(2024, 1, 2, 0, 0, 0, 0, time.FixedZone("IST", 5*3600+1800))
+	berlin := time.Date(2024, 1, 2, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name  string
+		store *sqlStore
+		q     BucketQuery
+		want  string
+	}{
+		{"hourly avg", timescale, BucketQuery{Origin: berlin, Interval: time.Hour, Fields: []string{"pv_input_power_w", "load_power_w"}, Fn: "avg"}, "device_data_hourly"},
+		{"daily min at UTC midnight", timescale, BucketQuery{Origin: utcMidnight, Interval: 24 * time.Hour, Fields: []string{"battery_voltage_v"}, Fn: "min"}, "device_data_daily"},
+		{"daily off UTC midnight", timescale, BucketQuery{Origin: berlin, Interval: 24 * time.Hour, Fields: []string{"battery_voltage_v"}, Fn: "min"}, ""},
+		{"hours off the UTC hour", timescale, BucketQuery{Origin: india, Interval: time.Hour, Fields: []string{"pv_input_power_w"}, Fn: "avg"}, ""},
+		{"interval without a rollup", timescale, BucketQuery{Origin: utcMidnight, Interval: 15 * time.Minute, Fields: []string{"pv_input_power_w"}, Fn: "avg"}, ""},
+		{"reduction the rollup lacks", timescale, BucketQuery{Origin: utcMidnight, Interval: time.Hour, Fields: []string{"pv_input_power_w"}, Fn: "min"}, ""},
+		{"last", timescale, BucketQuery{Origin: utcMidnight, Interval: time.Hour, Fields: []string{"battery_percentage"}, Fn: "last"}, ""},
+		{"column the rollup lacks", timescale, BucketQuery{Origin: utcMidnight, Interval: time.Hour, Fields: []string{"pv_input_power_w", "grid_voltage_v"}, Fn: "avg"}, ""},
+		{"postgres", &sqlStore{dialect: dialectPostgres}, BucketQuery{Origin: utcMidnight, Interval: time.Hour, Fields: []string{"pv_input_power_w"}, Fn: "avg"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view, ok := tt.store.rollupView(tt.q)
+			if view != tt.want || ok != (tt.want != "") {
+				t.Errorf("rollupView = %q, %v; want %q", view, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// deviceListPath is the open API listing of the devices (and their plants) on the account
+const deviceListPath = "/openApi/device/list"
+
+// FelicityDevice is one entry of the device list endpoint
+type FelicityDevice struct {
+	DeviceSn        string `json:"deviceSn"`
+	DeviceModel     string `json:"deviceModel"`
+	FirmwareVersion string `json:"firmwareVersion"`
+	RatedPower      string `json:"ratedPower"`
+	BatteryType     string `json:"batteryType"`
+	PlantID         string `json:"plantId"`
+	PlantName       string `json:"plantName"`
+}
+
+// device list response
+type DeviceListResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		DataList    []json.RawMessage `json:"datalist"`
+		Total       string            `json:"total"`
+		TotalPage   string            `json:"totalPage"`
+		PageSize    string            `json:"pageSize"`
+		CurrentPage string            `json:"currentPage"`
+	} `json:"data"`
+}
+
+func (r *DeviceListResponse) envelope() (int, string) { return r.Code, r.Message }
+
+// discoveredDevice pairs the decoded fields with the raw entry so nothing the API sends is lost
+type discoveredDevice struct {
+	FelicityDevice
+	Raw json.RawMessage
+}
+
+// ListDevices fetches every device on the account, walking all pages of the device list
+func (c *FelicityClient) ListDevices(ctx context.Context) ([]discoveredDevice, error) {
+	const pageSize = 50
+	var devices []discoveredDevice
+
+	for page := 1; page <= maxHistoryPages; page++ {
+		queryParams := url.Values{}
+		queryParams.Add("pageNum", strconv.Itoa(page))
+		queryParams.Add("pageSize", strconv.Itoa(pageSize))
+
+		var responseData DeviceListResponse
+		if _, err := c.doAuthorizedJSON(ctx, "device list", "GET", deviceListPath, queryParams, nil, &responseData); err != nil {
+			return nil, err
+		}
+
+		for _, raw := range responseData.Data.DataList {
+			var device FelicityDevice
+			if err := json.Unmarshal(raw, &device); err != nil {
+				return nil, fmt.Errorf("error decoding device list entry: %w", err)
+			}
+			if device.DeviceSn == "" {
+				continue
+			}
+			devices = append(devices, discoveredDevice{FelicityDevice: device, Raw: raw})
+		}
+
+		totalPages, err := strconv.Atoi(responseData.Data.TotalPage)
+		if err != nil {
+			if len(responseData.Data.DataList) < pageSize {
+				return devices, nil
+			}
+			continue
+		}
+		if page >= totalPages {
+			return devices, nil
+		}
+	}
+	return nil, fmt.Errorf("gave up after %d pages of device list", maxHistoryPages)
+}
+
+// saveDevices upserts device metadata, keeping the original discovered_at
+func saveDevices(db *sql.DB, devices []discoveredDevice) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO devices (device_sn, model, firmware_version, rated_power_w, battery_type, plant_id, plant_name, raw_json)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_sn) DO UPDATE SET
+			model = excluded.model,
+			firmware_version = excluded.firmware_version,
+			rated_power_w = excluded.rated_power_w,
+			battery_type = excluded.battery_type,
+			plant_id = excluded.plant_id,
+			plant_name = excluded.plant_name,
+			raw_json = excluded.raw_json,
+			updated_at = CURRENT_TIMESTAMP
+	`)
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, device := range devices {
+		_, err := stmt.Exec(device.DeviceSn, device.DeviceModel, device.FirmwareVersion, parseFloat(device.RatedPower),
+			device.BatteryType, device.PlantID, device.PlantName, string(device.Raw))
+		if err != nil {
+			return fmt.Errorf("error saving device %s: %w", device.DeviceSn, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// DiscoverDevices refreshes the devices table from the Felicity device list
+func DiscoverDevices(ctx context.Context, db *sql.DB, client *FelicityClient) ([]string, error) {
+	devices, err := client.ListDevices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing devices: %w", err)
+	}
+	if err := saveDevices(db, devices); err != nil {
+		return nil, err
+	}
+
+	serials := make([]string, 0, len(devices))
+	for _, device := range devices {
+		serials = append(serials, device.DeviceSn)
+	}
+	fmt.Printf("Discovered %d device(s) on the account.\n", len(serials))
+	return serials, nil
+}
+
+// knownDeviceSerials returns the serials already stored in the devices table
+func knownDeviceSerials(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT device_sn FROM devices ORDER BY device_sn")
+	if err != nil {
+		return nil, fmt.Errorf("error querying devices: %w", err)
+	}
+	defer rows.Close()
+
+	var serials []string
+	for rows.Next() {
+		var sn string
+		if err := rows.Scan(&sn); err != nil {
+			return nil, fmt.Errorf("error scanning device row: %w", err)
+		}
+		serials = append(serials, sn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating device rows: %w", err)
+	}
+	return serials, nil
+}
+
+// GetDeviceInfo returns the stored metadata for sn; only the serial is set if it was never discovered
+func GetDeviceInfo(db *sql.DB, sn string) (DeviceInfo, error) {
+	info := DeviceInfo{DeviceSn: sn}
+	var model, firmware, batteryType, plantID, plantName sql.NullString
+	var ratedPower sql.NullFloat64
+	var updatedAt sql.NullTime
+
+	err := db.QueryRow("SELECT model, firmware_version, rated_power_w, battery_type, plant_id, plant_name, updated_at FROM devices WHERE device_sn = ?", sn).Scan(
+		&model, &firmware, &ratedPower, &batteryType, &plantID, &plantName, &updatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return info, nil
+	}
+	if err != nil {
+		return info, fmt.Errorf("error querying device %s: %w", sn, err)
+	}
+
+	info.Model = model.String
+	info.FirmwareVersion = firmware.String
+	info.RatedPowerW = ratedPower.Float64
+	info.BatteryType = batteryType.String
+	info.PlantID = plantID.String
+	info.PlantName = plantName.String
+	if updatedAt.Valid {
+		info.UpdatedAt = &updatedAt.Time
+	}
+	return info, nil
+}
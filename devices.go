@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceInfo describes an inverter the API knows about, with metadata from device discovery
+type DeviceInfo struct {
+	DeviceSn        string     `json:"deviceSn"`
+	Model           string     `json:"model,omitempty"`
+	FirmwareVersion string     `json:"firmwareVersion,omitempty"`
+	RatedPowerW     float64    `json:"ratedPowerW,omitempty"`
+	BatteryType     string     `json:"batteryType,omitempty"`
+	PlantID         string     `json:"plantId,omitempty"`
+	PlantName       string     `json:"plantName,omitempty"`
+	UpdatedAt       *time.Time `json:"updatedAt,omitempty"`
+}
+
+// DevicesHandler lists the devices being ingested along with their stored metadata
+func DevicesHandler(app *App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		devices := make([]DeviceInfo, 0, len(app.Devices))
+		for _, sn := range app.Devices {
+			info, err := GetDeviceInfo(app.DB, sn)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching devices from database"})
+				return
+			}
+			devices = append(devices, info)
+		}
+		c.JSON(http.StatusOK, devices)
+	}
+}
+
+// DiscoverDevicesHandler refreshes device metadata from the Felicity account.
+// Newly found devices are stored but only ingested after a restart.
+func DiscoverDevicesHandler(app *App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serials, err := DiscoverDevices(c.Request.Context(), app.DB, app.Client)
+		if err != nil {
+			respondError(c, "Error discovering devices", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"discovered": serials})
+	}
+}
+
+// FilteredHistoryHandler serves time-filtered history one page at a time: from/to (or date),
+// limit (default 100, alias pageSize), order=asc|desc and cursor, taken from the next or prev
+// field of a previous response. With deviceSn empty the device comes from the device_sn
+// query parameter (all devices when absent).
+//
+// pageNum is deprecated but still accepted for existing clients: without a cursor it selects
+// a page by offset and the response is the bare array of rows it used to be, sent with a
+// Deprecation header. Offset pages get slower the deeper they go; use the cursors instead.
+func FilteredHistoryHandler(store HistoryStore, deviceSn string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sn := deviceSn
+		if sn == "" {
+			sn = c.Query("device_sn")
+		}
+		timeRange, err := historyTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		query := HistoryQuery{DeviceSn: sn, Range: timeRange, Limit: defaultHistoryLimit}
+		limitStr := c.DefaultQuery("limit", c.Query("pageSize"))
+		if limitStr != "" {
+			limit, err := strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 || limit > maxHistoryLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)})
+				return
+			}
+			query.Limit = limit
+		}
+		switch c.DefaultQuery("order", "asc") {
+		case "asc":
+		case "desc":
+			query.Descending = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+			return
+		}
+		pageNum := 0
+		if pageNumStr := c.Query("pageNum"); pageNumStr != "" {
+			if c.Query("cursor") != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "pass either cursor or the deprecated pageNum, not both"})
+				return
+			}
+			pageNum, err = strconv.Atoi(pageNumStr)
+			if err != nil || pageNum < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "pageNum must be a positive integer"})
+				return
+			}
+			query.Offset = (pageNum - 1) * query.Limit
+		}
+		if cursorStr := c.Query("cursor"); cursorStr != "" {
+			before, cursor, err := decodeHistoryCursor(cursorStr)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if before {
+				query.Before = &cursor
+			} else {
+				query.After = &cursor
+			}
+		}
+
+		page, err := store.HistoryPage(query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching filtered data from database"})
+			return
+		}
+		if pageNum > 0 {
+			c.Header("Deprecation", "true")
+			c.JSON(http.StatusOK, page.Rows)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"data":  page.Rows,
+			"total": page.Total,
+			"limit": query.Limit,
+			"order": c.DefaultQuery("order", "asc"),
+			"next":  encodeHistoryCursor(false, page.Next),
+			"prev":  encodeHistoryCursor(true, page.Prev),
+		})
+	}
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 5000
+)
+
+// encodeHistoryCursor makes an opaque cursor string; before marks a prev cursor.
+// A nil cursor encodes as null.
+func encodeHistoryCursor(before bool, cursor *HistoryCursor) *string {
+	if cursor == nil {
+		return nil
+	}
+	direction := "a"
+	if before {
+		direction = "b"
+	}
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", direction, cursor.Ts, cursor.ID)))
+	return &encoded
+}
+
+func decodeHistoryCursor(value string) (bool, HistoryCursor, error) {
+	invalid := fmt.Errorf("invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return false, HistoryCursor{}, invalid
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || (parts[0] != "a" && parts[0] != "b") {
+		return false, HistoryCursor{}, invalid
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false, HistoryCursor{}, invalid
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return false, HistoryCursor{}, invalid
+	}
+	return parts[0] == "b", HistoryCursor{Ts: ts, ID: id}, nil
+}
+
+// DeviceHistoryHandler serves /api/devices/:sn/history with the same filters as /api/history/filtered
+func DeviceHistoryHandler(app *App) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sn := c.Param("sn")
+		if !app.HasDevice(sn) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown device %s", sn)})
+			return
+		}
+		FilteredHistoryHandler(app.Store, sn)(c)
+	}
+}
+
+// historyTimeRange reads the time filter of a history request: either date, a plant-local
+// day (YYYY-MM-DD), or from/to given as RFC 3339 or dates
+func historyTimeRange(c *gin.Context) (TimeRange, error) {
+	dateStr, fromStr, toStr := c.Query("date"), c.Query("from"), c.Query("to")
+	if dateStr != "" {
+		if fromStr != "" || toStr != "" {
+			return TimeRange{}, fmt.Errorf("use either date or from/to, not both")
+		}
+		return dayRange(dateStr)
+	}
+	return parseTimeRange(fromStr, toStr)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFilteredHistoryDeprecatedPageNum(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newTestStore(t)
+	err := store.SaveHistory([]DeviceData{
+		{DeviceSn: "SN1", DeviceDataTime: "2024-01-02 10:00:00"},
+		{DeviceSn: "SN1", DeviceDataTime: "2024-01-02 10:05:00"},
+		{DeviceSn: "SN1", DeviceDataTime: "2024-01-02 10:10:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/api/history/filtered", FilteredHistoryHandler(store, ""))
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/history/filtered?"+query, nil))
+		return w
+	}
+
+	//old clients get the bare array of the requested page
+	w := get("date=2024-01-02&pageNum=2&pageSize=1")
+	var rows []DbData
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("pageNum request: %d %s", w.Code, w.Body)
+	}
+	if len(rows) != 1 || rows[0].LocalTime != "2024-01-02 10:05:00" || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("pageNum 2 = %+v (Deprecation %q), want the 10:05 row, deprecated", rows, w.Header().Get("Deprecation"))
+	}
+
+	var page struct {
+		Data []DbData
+		Next *string
+	}
+	w = get("date=2024-01-02&limit=2")
+	if err := json.Unmarshal(w.Body.Bytes(), &page); w.Code != http.StatusOK || err != nil || len(page.Data) != 2 || page.Next == nil {
+		t.Fatalf("cursor request: %d %s", w.Code, w.Body)
+	}
+
+	for _, query := range []string{"pageNum=0", "pageNum=two", "pageNum=1&cursor=" + *page.Next} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// energyColumns are the power columns integrated into energy, in the order samples hold them
+var energyColumns = []string{"pv_input_power_w", "battery_power_w", "load_power_w"}
+
+// EnergyOptions control how power samples are turned into energy
+type EnergyOptions struct {
+	// MaxGap is the longest stretch between two samples that is still integrated; across a
+	// longer gap (the logger was offline) nothing is assumed and no energy is counted
+	MaxGap time.Duration
+	// DischargePositive means a positive battery_power_w is the battery discharging;
+	// by default positive is charging
+	DischargePositive bool
+}
+
+// EnergyTotals is the energy one device moved during one period
+type EnergyTotals struct {
+	DeviceSn            string  `json:"deviceSn"`
+	Period              string  `json:"period"` // 2024-01-02, 2024-01 or 2024
+	Start               string  `json:"start"`  // RFC 3339, plant-local
+	PvKWh               float64 `json:"pvKWh"`
+	LoadKWh             float64 `json:"loadKWh"`
+	BatteryChargeKWh    float64 `json:"batteryChargeKWh"`
+	BatteryDischargeKWh float64 `json:"batteryDischargeKWh"`
+	CoverageHours       float64 `json:"coverageHours"` // time between samples that was integrated
+
+	start time.Time
+}
+
+// newEnergyTotals starts empty totals for deviceSn's period beginning at start
+func newEnergyTotals(deviceSn string, start time.Time, period string) EnergyTotals {
+	return EnergyTotals{
+		DeviceSn: deviceSn,
+		Period:   start.Format(energyPeriodLayouts[period]),
+		Start:    start.Format(time.RFC3339),
+		start:    start,
+	}
+}
+
+// maxEnergyPeriods caps the periods per device in one /api/energy response
+const maxEnergyPeriods = 400
+
+// defaultEnergyPeriods is how many periods, the current one last, /api/energy covers when no
+// range is given
+var defaultEnergyPeriods = map[string]int{"day": 7, "month": 12, "year": 5}
+
+// energy periods and the layout each is labelled with
+var energyPeriodLayouts = map[string]string{
+	"day":   backfillDateLayout,
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// periodStart returns the plant-local start of the day, month or year holding t
+func periodStart(t time.Time, period string) time.Time {
+	t = t.In(plantLocation)
+	switch period {
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, plantLocation)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, plantLocation)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, plantLocation)
+	}
+}
+
+// nextPeriod returns the start of the period after the one starting at start
+func nextPeriod(start time.Time, period string) time.Time {
+	switch period {
+	case "year":
+		return start.AddDate(1, 0, 0)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// trapezoidWh integrates power falling linearly from p0 to p1 over hours, split into the
+// energy above and below zero. A segment that changes sign is cut where it crosses zero; one
+// that only touches zero at an end lies wholly on the side of its other end.
+func trapezoidWh(p0, p1, hours float64) (positive, negative float64) {
+	if p0*p1 >= 0 {
+		area := (p0 + p1) / 2 * hours
+		if area >= 0 {
+			return area, 0
+		}
+		return 0, -area
+	}
+	crossing := p0 / (p0 - p1) * hours
+	if p0 > 0 {
+		return p0 / 2 * crossing, -p1 / 2 * (hours - crossing)
+	}
+	return p1 / 2 * (hours - crossing), -p0 / 2 * crossing
+}
+
+// IntegrateEnergy integrates samples (energyColumns, ordered by device and time as HistorySamples
+// returns them) into per-device totals for each period. Pairs of samples further apart than
+// opts.MaxGap are skipped. A pair straddling a period boundary or an edge of timeRange is cut
+// there, with the power at the cut interpolated, so each period only gets its own share.
+func IntegrateEnergy(samples []Sample, period string, timeRange TimeRange, opts EnergyOptions) []EnergyTotals {
+	totals := []EnergyTotals{}
+	var current *EnergyTotals
+
+	add := func(deviceSn string, from, to time.Time, p0, p1 []float64, valid []bool) {
+		start := periodStart(from, period)
+		if current == nil || current.DeviceSn != deviceSn || !current.start.Equal(start) {
+			totals = append(totals, newEnergyTotals(deviceSn, start, period))
+			current = &totals[len(totals)-1]
+		}
+
+		hours := to.Sub(from).Hours()
+		current.CoverageHours += hours
+		if valid[0] {
+			pv, _ := trapezoidWh(p0[0], p1[0], hours)
+			current.PvKWh += pv / 1000
+		}
+		if valid[1] {
+			charge, discharge := trapezoidWh(p0[1], p1[1], hours)
+			if opts.DischargePositive {
+				charge, discharge = discharge, charge
+			}
+			current.BatteryChargeKWh += charge / 1000
+			current.BatteryDischargeKWh += discharge / 1000
+		}
+		if valid[2] {
+			load, _ := trapezoidWh(p0[2], p1[2], hours)
+			current.LoadKWh += load / 1000
+		}
+	}
+
+	for i := 1; i < len(samples); i++ {
+		prev, next := samples[i-1], samples[i]
+		if prev.DeviceSn != next.DeviceSn || next.Ts <= prev.Ts {
+			continue
+		}
+		t0, t1 := time.Unix(prev.Ts, 0), time.Unix(next.Ts, 0)
+		if t1.Sub(t0) > opts.MaxGap {
+			continue
+		}
+
+		valid := make([]bool, len(energyColumns))
+		v0 := make([]float64, len(energyColumns))
+		v1 := make([]float64, len(energyColumns))
+		for c := range energyColumns {
+			valid[c] = prev.Values[c].Valid && next.Values[c].Valid
+			v0[c], v1[c] = prev.Values[c].Float64, next.Values[c].Float64
+		}
+		at := func(t time.Time) []float64 {
+			f := t.Sub(t0).Seconds() / t1.Sub(t0).Seconds()
+			p := make([]float64, len(energyColumns))
+			for c := range p {
+				p[c] = v0[c] + (v1[c]-v0[c])*f
+			}
+			return p
+		}
+
+		//walk the pair piece by piece, cutting at period boundaries and the range edges
+		from := t0
+		for from.Before(t1) {
+			to := nextPeriod(periodStart(from, period), period)
+			for _, edge := range []time.Time{timeRange.From, timeRange.To, t1} {
+				if !edge.IsZero() && edge.After(from) && edge.Before(to) {
+					to = edge
+				}
+			}
+			inRange := (timeRange.From.IsZero() || !from.Before(timeRange.From)) &&
+				(timeRange.To.IsZero() || !to.After(timeRange.To))
+			if inRange {
+				add(next.DeviceSn, from, to, at(from), at(to), valid)
+			}
+			from = to
+		}
+	}
+	return totals
+}
+
+// ComputeEnergy totals the energy in timeRange, which must be bounded, per device and period.
+// Day periods are integrated from the power samples. Month and year periods add up the stored
+// daily summaries of the whole days in the range, integrating samples only for the partial
+// days at its edges, so a year costs one row per day rather than every sample.
+func ComputeEnergy(store Store, deviceSn, period string, timeRange TimeRange, opts EnergyOptions) ([]EnergyTotals, error) {
+	if _, ok := energyPeriodLayouts[period]; !ok {
+		return nil, fmt.Errorf("period must be day, month or year")
+	}
+	if timeRange.From.IsZero() || timeRange.To.IsZero() {
+		return nil, fmt.Errorf("energy range must be bounded")
+	}
+
+	firstDay := periodStart(timeRange.From, "day")
+	if firstDay.Before(timeRange.From) {
+		firstDay = nextPeriod(firstDay, "day")
+	}
+	endDay := periodStart(timeRange.To, "day")
+	if period == "day" || !firstDay.Before(endDay) {
+		return integrateEnergyRange(store, deviceSn, period, timeRange, opts)
+	}
+
+	var totals []EnergyTotals
+	for _, edge := range []TimeRange{{From: timeRange.From, To: firstDay}, {From: endDay, To: timeRange.To}} {
+		if !edge.From.Before(edge.To) {
+			continue
+		}
+		edgeTotals, err := integrateEnergyRange(store, deviceSn, period, edge, opts)
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, edgeTotals...)
+	}
+
+	summaries, err := store.DailySummaries(deviceSn, firstDay.Format(backfillDateLayout), endDay.AddDate(0, 0, -1).Format(backfillDateLayout))
+	if err != nil {
+		return nil, err
+	}
+	for _, summary := range summaries {
+		day, err := time.ParseInLocation(backfillDateLayout, summary.Day, plantLocation)
+		if err != nil {
+			return nil, fmt.Errorf("invalid day %q in the summary of %s: %w", summary.Day, summary.DeviceSn, err)
+		}
+		t := newEnergyTotals(summary.DeviceSn, periodStart(day, period), period)
+		t.PvKWh, t.LoadKWh = summary.PvKWh, summary.LoadKWh
+		t.BatteryChargeKWh, t.BatteryDischargeKWh = summary.BatteryChargeKWh, summary.BatteryDischargeKWh
+		t.CoverageHours = summary.CoverageHours
+		totals = append(totals, t)
+	}
+	return mergeEnergyTotals(totals), nil
+}
+
+// integrateEnergyRange reads the power samples for timeRange and integrates them per period.
+// Samples up to opts.MaxGap either side of the range are read too, so the first and last pairs count.
+func integrateEnergyRange(store HistoryStore, deviceSn, period string, timeRange TimeRange, opts EnergyOptions) ([]EnergyTotals, error) {
+	padded := TimeRange{From: timeRange.From.Add(-opts.MaxGap), To: timeRange.To.Add(opts.MaxGap)}
+	samples, err := store.HistorySamples(deviceSn, padded, energyColumns)
+	if err != nil {
+		return nil, err
+	}
+	return IntegrateEnergy(samples, period, timeRange, opts), nil
+}
+
+// mergeEnergyTotals adds up the totals of the same device and period, ordered by device and period
+func mergeEnergyTotals(totals []EnergyTotals) []EnergyTotals {
+	slices.SortStableFunc(totals, func(a, b EnergyTotals) int {
+		if c := strings.Compare(a.DeviceSn, b.DeviceSn); c != 0 {
+			return c
+		}
+		return a.start.Compare(b.start)
+	})
+	merged := []EnergyTotals{}
+	for _, t := range totals {
+		if n := len(merged); n > 0 && merged[n-1].DeviceSn == t.DeviceSn && merged[n-1].start.Equal(t.start) {
+			last := &merged[n-1]
+			last.PvKWh += t.PvKWh
+			last.LoadKWh += t.LoadKWh
+			last.BatteryChargeKWh += t.BatteryChargeKWh
+			last.BatteryDischargeKWh += t.BatteryDischargeKWh
+			last.CoverageHours += t.CoverageHours
+			continue
+		}
+		merged = append(merged, t)
+	}
+	return merged
+}
+
+// roundKWh keeps totals to the watt-hour
+func roundKWh(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// EnergyHandler serves /api/energy: kWh totals per device and period (?period=day|month|year,
+// default day) over a time range given as from/to or date, for one device with device_sn.
+// Without a range it covers the last defaultEnergyPeriods periods up to now.
+func EnergyHandler(store Store, opts EnergyOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeRange, err := historyTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		period := c.DefaultQuery("period", "day")
+		if _, ok := energyPeriodLayouts[period]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day, month or year"})
+			return
+		}
+
+		//the range must be bounded, so the periods (and the samples read) are too
+		switch {
+		case timeRange.From.IsZero() && timeRange.To.IsZero():
+			now := time.Now()
+			from := periodStart(now, period)
+			for range defaultEnergyPeriods[period] - 1 {
+				from = periodStart(from.Add(-time.Hour), period)
+			}
+			timeRange = TimeRange{From: from, To: now}
+		case timeRange.From.IsZero() || timeRange.To.IsZero():
+			c.JSON(http.StatusBadRequest, gin.H{"error": "give both from and to, or neither for the most recent periods"})
+			return
+		}
+		periods := 0
+		for start := periodStart(timeRange.From, period); start.Before(timeRange.To); start = nextPeriod(start, period) {
+			if periods++; periods > maxEnergyPeriods {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("more than %d periods, use a longer period or a shorter range", maxEnergyPeriods)})
+				return
+			}
+		}
+
+		totals, err := ComputeEnergy(store, c.Query("device_sn"), period, timeRange, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error computing energy from history"})
+			return
+		}
+		for i := range totals {
+			t := &totals[i]
+			t.PvKWh, t.LoadKWh = roundKWh(t.PvKWh), roundKWh(t.LoadKWh)
+			t.BatteryChargeKWh, t.BatteryDischargeKWh = roundKWh(t.BatteryChargeKWh), roundKWh(t.BatteryDischargeKWh)
+			t.CoverageHours = math.Round(t.CoverageHours*100) / 100
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"period": period,
+			"from":   timeRange.From.In(plantLocation).Format(time.RFC3339),
+			"to":     timeRange.To.In(plantLocation).Format(time.RFC3339),
+			"totals": totals,
+		})
+	}
+}
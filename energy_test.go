@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTrapezoidWh(t *testing.T) {
+	tests := []struct {
+		name               string
+		p0, p1, hours      float64
+		positive, negative float64
+	}{
+		{"constant positive", 100, 100, 1, 100, 0},
+		{"constant negative", -100, -100, 1, 0, 100},
+		{"all zero", 0, 0, 1, 0, 0},
+		{"zero to positive", 0, 100, 1, 50, 0},
+		{"positive to zero", 100, 0, 1, 50, 0},
+		{"zero to negative", 0, -100, 1, 0, 50},
+		{"negative to zero", -100, 0, 1, 0, 50},
+		{"positive to negative", 100, -100, 1, 25, 25},
+		{"negative to positive", -100, 100, 1, 25, 25},
+		{"uneven crossing", 300, -100, 2, 225, 25},
+		{"no time", 100, -100, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			positive, negative := trapezoidWh(tt.p0, tt.p1, tt.hours)
+			if !near(positive, tt.positive) || !near(negative, tt.negative) {
+				t.Errorf("trapezoidWh(%v, %v, %v) = (%v, %v), want (%v, %v)",
+					tt.p0, tt.p1, tt.hours, positive, negative, tt.positive, tt.negative)
+			}
+		})
+	}
+}
+
+func TestIntegrateEnergy(t *testing.T) {
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, plantLocation)
+	at := func(hours float64) time.Time {
+		return day.Add(time.Duration(hours * float64(time.Hour)))
+	}
+	february := time.Date(2024, 2, 1, 0, 0, 0, 0, plantLocation)
+	opts := EnergyOptions{MaxGap: time.Hour}
+
+	tests := []struct {
+		name      string
+		samples   []Sample
+		period    string
+		timeRange TimeRange
+		opts      EnergyOptions
+		want      []EnergyTotals // only the fields compared below are set
+	}{
+		{
+			name:    "constant power",
+			samples: []Sample{sample("A", at(10), 1000, 0, 500), sample("A", at(11), 1000, 0, 500)},
+			period:  "day",
+			opts:    opts,
+			want:    []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", PvKWh: 1, LoadKWh: 0.5, CoverageHours: 1}},
+		},
+		{
+			name:    "gap longer than MaxGap is skipped",
+			samples: []Sample{sample("A", at(10), 1000, 0, 0), sample("A", at(12), 1000, 0, 0), sample("A", at(12.5), 1000, 0, 0)},
+			period:  "day",
+			opts:    opts,
+			want:    []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", PvKWh: 0.5, CoverageHours: 0.5}},
+		},
+		{
+			name:    "pair across midnight is split between the days",
+			samples: []Sample{sample("A", at(23.5), 1000, 0, 0), sample("A", at(24.5), 1000, 0, 0)},
+			period:  "day",
+			opts:    opts,
+			want: []EnergyTotals{
+				{DeviceSn: "A", Period: "2024-01-15", PvKWh: 0.5, CoverageHours: 0.5},
+				{DeviceSn: "A", Period: "2024-01-16", PvKWh: 0.5, CoverageHours: 0.5},
+			},
+		},
+		{
+			name:    "pair across a month boundary",
+			samples: []Sample{sample("A", february.Add(-30*time.Minute), 0, 0, 0), sample("A", february.Add(30*time.Minute), 2000, 0, 0)},
+			period:  "month",
+			opts:    opts,
+			want: []EnergyTotals{
+				{DeviceSn: "A", Period: "2024-01", PvKWh: 0.25, CoverageHours: 0.5},
+				{DeviceSn: "A", Period: "2024-02", PvKWh: 0.75, CoverageHours: 0.5},
+			},
+		},
+		{
+			name:      "range edge cuts the pair",
+			samples:   []Sample{sample("A", at(9.5), 1000, 0, 0), sample("A", at(10.5), 1000, 0, 0)},
+			period:    "day",
+			timeRange: TimeRange{From: at(10), To: at(11)},
+			opts:      opts,
+			want:      []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", PvKWh: 0.5, CoverageHours: 0.5}},
+		},
+		{
+			name:    "battery crossing zero splits charge and discharge",
+			samples: []Sample{sample("A", at(10), 0, 100, 0), sample("A", at(11), 0, -100, 0)},
+			period:  "day",
+			opts:    opts,
+			want:    []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", BatteryChargeKWh: 0.025, BatteryDischargeKWh: 0.025, CoverageHours: 1}},
+		},
+		{
+			name:    "battery falling from zero is discharge",
+			samples: []Sample{sample("A", at(10), 0, 0, 0), sample("A", at(11), 0, -100, 0)},
+			period:  "day",
+			opts:    opts,
+			want:    []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", BatteryDischargeKWh: 0.05, CoverageHours: 1}},
+		},
+		{
+			name:    "discharge positive swaps the battery sides",
+			samples: []Sample{sample("A", at(10), 0, 0, 0), sample("A", at(11), 0, -100, 0)},
+			period:  "day",
+			opts:    EnergyOptions{MaxGap: time.Hour, DischargePositive: true},
+			want:    []EnergyTotals{{DeviceSn: "A", Period: "2024-01-15", BatteryChargeKWh: 0.05, CoverageHours: 1}},
+		},
+		{
+			name:    "devices are not paired with each other",
+			samples: []Sample{sample("A", at(10), 1000, 0, 0), sample("B", at(10.5), 1000, 0, 0), sample("B", at(11), 1000, 0, 0)},
+			period:  "day",
+			opts:    opts,
+			want:    []EnergyTotals{{DeviceSn: "B", Period: "2024-01-15", PvKWh: 0.5, CoverageHours: 0.5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IntegrateEnergy(tt.samples, tt.period, tt.timeRange, tt.opts)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d totals, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, want := range tt.want {
+				g := got[i]
+				if g.DeviceSn != want.DeviceSn || g.Period != want.Period ||
+					!near(g.PvKWh, want.PvKWh) || !near(g.LoadKWh, want.LoadKWh) ||
+					!near(g.BatteryChargeKWh, want.BatteryChargeKWh) || !near(g.BatteryDischargeKWh, want.BatteryDischargeKWh) ||
+					!near(g.CoverageHours, want.CoverageHours) {
+					t.Errorf("totals[%d] = %+v, want %+v", i, g, want)
+				}
+			}
+		})
+	}
+}
+
+func TestComputeEnergyMonthFromDailySummaries(t *testing.T) {
+	store := newTestStore(t)
+	opts := EnergyOptions{MaxGap: time.Hour}
+
+	//whole days come from their summaries alone, no samples are stored for them
+	for _, summary := range []DailySummary{
+		{DeviceSn: "A", Day: "2024-01-15", PvKWh: 5, LoadKWh: 2, CoverageHours: 24},
+		{DeviceSn: "A", Day: "2024-02-01", PvKWh: 3, CoverageHours: 24},
+		{DeviceSn: "A", Day: "2024-02-10", PvKWh: 100, CoverageHours: 24}, // outside the range
+	} {
+		if err := store.SaveDailySummary(summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the partial days at the edges are integrated from samples, not their (whole day) summaries
+	err := store.SaveHistory([]DeviceData{
+		{DeviceSn: "A", DeviceDataTime: "2024-01-10 10:00:00", PvTotalPower: "1000"},
+		{DeviceSn: "A", DeviceDataTime: "2024-01-10 11:00:00", PvTotalPower: "1000"},
+		{DeviceSn: "A", DeviceDataTime: "2024-02-05 08:00:00", PvTotalPower: "2000"},
+		{DeviceSn: "A", DeviceDataTime: "2024-02-05 09:00:00", PvTotalPower: "2000"},
+		{DeviceSn: "A", DeviceDataTime: "2024-02-05 11:00:00", PvTotalPower: "2000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveDailySummary(DailySummary{DeviceSn: "A", Day: "2024-01-10", PvKWh: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeRange := TimeRange{
+		From: time.Date(2024, 1, 10, 10, 30, 0, 0, plantLocation),
+		To:   time.Date(2024, 2, 5, 9, 0, 0, 0, plantLocation),
+	}
+	got, err := ComputeEnergy(store, "A", "month", timeRange, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnergyTotals{
+		{DeviceSn: "A", Period: "2024-01", PvKWh: 5.5, LoadKWh: 2, CoverageHours: 24.5},
+		{DeviceSn: "A", Period: "2024-02", PvKWh: 5, CoverageHours: 25},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.DeviceSn != w.DeviceSn || g.Period != w.Period || !near(g.PvKWh, w.PvKWh) || !near(g.LoadKWh, w.LoadKWh) || !near(g.CoverageHours, w.CoverageHours) {
+			t.Errorf("totals[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+
+	if _, err := ComputeEnergy(store, "A", "month", TimeRange{From: timeRange.From}, opts); err == nil {
+		t.Error("unbounded range: no error")
+	}
+}
+
+func TestEnergyHandlerRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/energy", EnergyHandler(newTestStore(t), EnergyOptions{MaxGap: time.Hour}))
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/energy?"+query, nil))
+		return w
+	}
+
+	//without a range the last 12 months up to now are covered
+	w := get("period=month")
+	var body struct{ From, To string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("default range: %d %s", w.Code, w.Body)
+	}
+	from, err := time.Parse(time.RFC3339, body.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().In(plantLocation)
+	wantFrom := time.Date(now.Year(), now.Month()-11, 1, 0, 0, 0, 0, plantLocation)
+	if !from.Equal(wantFrom) {
+		t.Errorf("default from = %s, want %s", body.From, wantFrom.Format(time.RFC3339))
+	}
+
+	for _, query := range []string{
+		"period=day&from=2024-01-01",
+		"period=day&to=2024-01-01",
+		"period=day&from=2020-01-01&to=2024-01-01", // more than maxEnergyPeriods days
+	} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+	if w := get("period=month&from=2020-01-01&to=2024-01-01"); w.Code != http.StatusOK {
+		t.Errorf("48 months: status %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+// sample builds a Sample of energyColumns (pv, battery, load) at t
+func sample(deviceSn string, t time.Time, pv, battery, load float64) Sample {
+	return Sample{DeviceSn: deviceSn, Ts: t.Unix(), Values: []sql.NullFloat64{
+		{Float64: pv, Valid: true}, {Float64: battery, Valid: true}, {Float64: load, Valid: true},
+	}}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// alarmListPath is the open API listing of a device's alarms and faults
+const alarmListPath = "/openApi/data/deviceAlarmList/"
+
+// event severities, from least to most serious
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityFault   = "fault"
+)
+
+// event sources
+const (
+	eventSourceAlarmAPI = "alarm_api" // the alarm list endpoint
+	eventSourceHistory  = "history"   // fault/warning codes embedded in history records
+)
+
+// FelicityAlarm is one entry of the alarm list endpoint
+type FelicityAlarm struct {
+	DeviceSn    string `json:"deviceSn"`
+	AlarmCode   string `json:"alarmCode"`
+	AlarmName   string `json:"alarmName"`
+	AlarmLevel  string `json:"alarmLevel"`
+	StartTime   string `json:"startTime"`
+	EndTime     string `json:"endTime"`
+	Description string `json:"description"`
+}
+
+// alarm list response
+type DeviceAlarmListResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		DataList  []json.RawMessage `json:"datalist"`
+		Total     string            `json:"total"`
+		TotalPage string            `json:"totalPage"`
+	} `json:"data"`
+}
+
+func (r *DeviceAlarmListResponse) envelope() (int, string) { return r.Code, r.Message }
+
+// Event is an alarm or fault reported by an inverter
+type Event struct {
+	ID          int64   `json:"id"`
+	DeviceSn    string  `json:"deviceSn"`
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	Severity    string  `json:"severity"`
+	Source      string  `json:"source"`
+	StartTime   string  `json:"startTime"`
+	EndTime     *string `json:"endTime"` // nil while the event is still active
+	LastSeen    string  `json:"lastSeen"`
+}
+
+// FetchDeviceAlarms fetches every alarm raised on dateStr (YYYY-MM-DD) for a device
+func (c *FelicityClient) FetchDeviceAlarms(ctx context.Context, deviceSn, dateStr string) ([]FelicityAlarm, []json.RawMessage, error) {
+	const pageSize = 50
+	var alarms []FelicityAlarm
+	var raws []json.RawMessage
+
+	for page := 1; page <= maxHistoryPages; page++ {
+		queryParams := url.Values{}
+		queryParams.Add("dateStr", dateStr)
+		queryParams.Add("pageNum", strconv.Itoa(page))
+		queryParams.Add("pageSize", strconv.Itoa(pageSize))
+
+		var responseData DeviceAlarmListResponse
+		if _, err := c.doAuthorizedJSON(ctx, "alarm list", "GET", alarmListPath+url.PathEscape(deviceSn), queryParams, nil, &responseData); err != nil {
+			return nil, nil, err
+		}
+
+		for _, raw := range responseData.Data.DataList {
+			var alarm FelicityAlarm
+			if err := json.Unmarshal(raw, &alarm); err != nil {
+				return nil, nil, fmt.Errorf("error decoding alarm entry: %w", err)
+			}
+			alarms = append(alarms, alarm)
+			raws = append(raws, raw)
+		}
+
+		totalPages, err := strconv.Atoi(responseData.Data.TotalPage)
+		if (err != nil && len(responseData.Data.DataList) < pageSize) || (err == nil && page >= totalPages) {
+			return alarms, raws, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("gave up after %d pages of alarm list", maxHistoryPages)
+}
+
+// alarmSeverity maps the API's alarm level onto our severities
+func alarmSeverity(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	switch {
+	case level == "3" || strings.Contains(level, "fault") || strings.Contains(level, "error") || strings.Contains(level, "critical"):
+		return SeverityFault
+	case level == "2" || strings.Contains(level, "warn"):
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// IngestDeviceAlarms stores the alarms the API reports for a device on dateStr
+func IngestDeviceAlarms(ctx context.Context, db *sql.DB, client *FelicityClient, deviceSn, dateStr string) (int, error) {
+	alarms, raws, err := client.FetchDeviceAlarms(ctx, deviceSn, dateStr)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO events (device_sn, code, description, severity, source, start_time, end_time, last_seen, raw_json, start_ts, end_ts, last_seen_ts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(device_sn, source, code, start_time) DO UPDATE SET
+			description = excluded.description,
+			severity = excluded.severity,
+			end_time = excluded.end_time,
+			end_ts = excluded.end_ts,
+			last_seen = excluded.last_seen,
+			last_seen_ts = excluded.last_seen_ts,
+			raw_json = excluded.raw_json
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for i, alarm := range alarms {
+		description := alarm.Description
+		if description == "" {
+			description = alarm.AlarmName
+		}
+		var endTime, endTs interface{}
+		lastSeen := alarm.StartTime
+		if alarm.EndTime != "" {
+			endTime, endTs = alarm.EndTime, deviceTimestamp(alarm.EndTime)
+			lastSeen = alarm.EndTime
+		}
+		_, err := stmt.Exec(deviceSn, alarm.AlarmCode, description, alarmSeverity(alarm.AlarmLevel), eventSourceAlarmAPI,
+			alarm.StartTime, endTime, lastSeen, string(raws[i]), deviceTimestamp(alarm.StartTime), endTs, deviceTimestamp(lastSeen))
+		if err != nil {
+			return 0, fmt.Errorf("error saving alarm %s: %w", alarm.AlarmCode, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return len(alarms), nil
+}
+
+// activeCodes returns the fault/warning codes set on a history record, keyed by code
+func activeCodes(data DeviceData) map[string]string {
+	codes := make(map[string]string)
+	if code := strings.TrimSpace(data.WarningCode); code != "" && code != "0" {
+		codes["W"+code] = SeverityWarning
+	}
+	if code := strings.TrimSpace(data.FaultCode); code != "" && code != "0" {
+		codes["F"+code] = SeverityFault
+	}
+	return codes
+}
+
+// recordHistoryEvents turns fault/warning codes in history records into events: a code
+// appearing opens an event, and the first later record without it closes the event.
+// Re-ingesting records already covered by an event is a no-op. Records are ordered and
+// compared by their parsed time, not the device's time string, whose format varies.
+func recordHistoryEvents(db *sql.DB, dataList []DeviceData) error {
+	//records whose time can't be parsed can't be placed on the timeline, so they don't count
+	type timedRecord struct {
+		data DeviceData
+		ts   int64
+	}
+	records := make([]timedRecord, 0, len(dataList))
+	for _, data := range dataList {
+		if t, err := parseDeviceTime(data.DeviceDataTime); err == nil {
+			records = append(records, timedRecord{data, t.Unix()})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].data.DeviceSn != records[j].data.DeviceSn {
+			return records[i].data.DeviceSn < records[j].data.DeviceSn
+		}
+		return records[i].ts < records[j].ts
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, record := range records {
+		data, ts := record.data, record.ts
+		active := activeCodes(data)
+
+		//close open events whose code has cleared by this record
+		closeQuery := "UPDATE events SET end_time = ?, end_ts = ? WHERE device_sn = ? AND source = ? AND end_time IS NULL AND last_seen_ts < ?"
+		closeArgs := []interface{}{data.DeviceDataTime, ts, data.DeviceSn, eventSourceHistory, ts}
+		if len(active) > 0 {
+			placeholders := make([]string, 0, len(active))
+			for code := range active {
+				placeholders = append(placeholders, "?")
+				closeArgs = append(closeArgs, code)
+			}
+			closeQuery += " AND code NOT IN (" + strings.Join(placeholders, ", ") + ")"
+		}
+		if _, err := tx.Exec(closeQuery, closeArgs...); err != nil {
+			return fmt.Errorf("error closing events: %w", err)
+		}
+
+		for code, severity := range active {
+			result, err := tx.Exec("UPDATE events SET last_seen = ?, last_seen_ts = ? WHERE device_sn = ? AND source = ? AND code = ? AND end_time IS NULL AND last_seen_ts < ?",
+				data.DeviceDataTime, ts, data.DeviceSn, eventSourceHistory, code, ts)
+			if err != nil {
+				return fmt.Errorf("error updating event %s: %w", code, err)
+			}
+			if updated, _ := result.RowsAffected(); updated > 0 {
+				continue
+			}
+
+			_, err = tx.Exec(`INSERT INTO events (device_sn, code, description, severity, source, start_time, last_seen, start_ts, last_seen_ts)
+				SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?
+				WHERE NOT EXISTS (
+					SELECT 1 FROM events WHERE device_sn = ? AND source = ? AND code = ?
+					AND start_ts <= ? AND (end_time IS NULL OR end_ts > ?)
+				)
+				ON CONFLICT(device_sn, source, code, start_time) DO NOTHING`,
+				data.DeviceSn, code, fmt.Sprintf("Inverter %s code %s", severity, code[1:]), severity, eventSourceHistory, data.DeviceDataTime, data.DeviceDataTime, ts, ts,
+				data.DeviceSn, eventSourceHistory, code, ts, ts)
+			if err != nil {
+				return fmt.Errorf("error opening event %s: %w", code, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// clearHistoryEvents deletes the events recordHistoryEvents derived for deviceSns, so a replay
+// can rebuild them; alarm API events are kept
+func clearHistoryEvents(db *sql.DB, deviceSns []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, deviceSn := range deviceSns {
+		if _, err := tx.Exec("DELETE FROM events WHERE device_sn = ? AND source = ?", deviceSn, eventSourceHistory); err != nil {
+			return fmt.Errorf("error clearing history events of %s: %w", deviceSn, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// EventFilter narrows GetEvents; empty fields match everything
+type EventFilter struct {
+	DeviceSn string
+	Severity string
+	Range    TimeRange // on the event's start
+	Limit    int
+}
+
+// GetEvents returns events matching filter, newest first
+func GetEvents(db *sql.DB, filter EventFilter) ([]Event, error) {
+	query := "SELECT id, device_sn, code, COALESCE(description, ''), severity, source, start_time, end_time, COALESCE(last_seen, start_time) FROM events"
+	conditions, args := filter.Range.conditions("start_ts")
+
+	if filter.DeviceSn != "" {
+		conditions = append(conditions, "device_sn = ?")
+		args = append(args, filter.DeviceSn)
+	}
+	if filter.Severity != "" {
+		conditions = append(conditions, "severity = ?")
+		args = append(args, filter.Severity)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY start_ts DESC, id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var endTime sql.NullString
+		if err := rows.Scan(&event.ID, &event.DeviceSn, &event.Code, &event.Description, &event.Severity, &event.Source, &event.StartTime, &endTime, &event.LastSeen); err != nil {
+			return nil, fmt.Errorf("error scanning event row: %w", err)
+		}
+		event.StartTime = isoDeviceTime(event.StartTime)
+		event.LastSeen = isoDeviceTime(event.LastSeen)
+		if endTime.Valid {
+			end := isoDeviceTime(endTime.String)
+			event.EndTime = &end
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating event rows: %w", err)
+	}
+	return events, nil
+}
+
+// EventsHandler serves GET /api/events?device_sn=&severity=&from=&to=&limit=
+func EventsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := EventFilter{
+			DeviceSn: c.Query("device_sn"),
+			Severity: c.Query("severity"),
+			Limit:    500,
+		}
+		timeRange, err := parseTimeRange(c.Query("from"), c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.Range = timeRange
+		switch filter.Severity {
+		case "", SeverityInfo, SeverityWarning, SeverityFault:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "severity must be info, warning or fault"})
+			return
+		}
+		if limitStr := c.Query("limit"); limitStr != "" {
+			limit, err := strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			filter.Limit = limit
+		}
+
+		events, err := GetEvents(db, filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching events from database"})
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultBaseURL = "https://shine-api.felicitysolar.com" // Base URL from documentation
+const defaultUserAgent = "inverter-api/1.0"
+const defaultClientTimeout = 30 * time.Second
+
+// TokenSource supplies access tokens for authenticated Felicity calls. Invalidate is called
+// with a token the server rejected so the next Token call renews it.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+	Invalidate(accessToken string)
+}
+
+// apiEnvelope is implemented by response types carrying the standard code/message envelope
+type apiEnvelope interface {
+	envelope() (code int, message string)
+}
+
+// FelicityClient talks to the Felicity open API. All endpoints are methods taking a context
+// so callers can cancel them; BaseURL and HTTPClient can be swapped for regional hosts or a
+// local stand-in server.
+type FelicityClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	UserAgent  string
+	Tokens     TokenSource
+	Retry      RetryPolicy
+	Limiter    *RateLimiter    // nil disables client-side rate limiting
+	Archive    ResponseArchive // nil disables the raw response archive
+}
+
+// NewFelicityClient creates a client for baseURL. A nil transport uses http.DefaultTransport.
+func NewFelicityClient(baseURL string, transport http.RoundTripper, timeout time.Duration) *FelicityClient {
+	if baseURL == "" {
+		baseURL = defaultBaseURL
+	}
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	return &FelicityClient{
+		BaseURL: baseURL,
+		HTTPClient: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		UserAgent: defaultUserAgent,
+		Retry:     defaultRetryPolicy,
+	}
+}
+
+// newRequest builds a request against BaseURL, JSON-encoding body when it isn't nil
+func (c *FelicityClient) newRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	apiURL, err := url.Parse(c.BaseURL + path)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %w", err)
+	}
+	if query != nil {
+		apiURL.RawQuery = query.Encode()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		requestBodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling request body: %w", err)
+		}
+		bodyReader = bytes.NewReader(requestBodyBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL.String(), bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// newAuthorizedRequest is newRequest plus an Authorization header from the token source
+func (c *FelicityClient) newAuthorizedRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	if c.Tokens == nil {
+		return nil, fmt.Errorf("felicity client has no token source")
+	}
+	accessToken, err := c.Tokens.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error obtaining access token: %w", err)
+	}
+
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", accessToken)
+	return req, nil
+}
+
+// do sends req through the shared rate limiter, retrying transient failures. Errors are
+// returned as they are; callers wrap them with the endpoint they were calling.
+func (c *FelicityClient) do(req *http.Request) (*http.Response, error) {
+	return doWithRetry(c.HTTPClient, c.Limiter, c.Retry, req)
+}
+
+// doAuthorizedJSON performs an authenticated request and decodes the JSON envelope into out,
+// returning the raw response body. When the access token is rejected (HTTP 401 or code 998)
+// it is invalidated and the request is replayed once with a renewed token.
+// Rate limit and server error codes in the envelope are retried like their HTTP equivalents.
+func (c *FelicityClient) doAuthorizedJSON(ctx context.Context, op, method, path string, query url.Values, body interface{}, out apiEnvelope) ([]byte, error) {
+	var raw []byte
+	err := c.withEnvelopeRetry(ctx, op, func() error {
+		var err error
+		raw, err = c.authorizedJSONOnce(ctx, op, method, path, query, body, out)
+		if err == nil || !errors.Is(err, ErrTokenExpired) {
+			return err
+		}
+
+		fmt.Printf("%s: access token rejected (%v), renewing and replaying request once\n", op, err)
+		metrics.AuthReplays.Add(1)
+
+		raw, err = c.authorizedJSONOnce(ctx, op, method, path, query, body, out)
+		if err != nil {
+			metrics.AuthReplayFailures.Add(1)
+			fmt.Printf("%s: replay after re-authentication failed: %v\n", op, err)
+		}
+		return err
+	})
+	return raw, err
+}
+
+// withEnvelopeRetry calls call again, backing off as for HTTP retries, while it fails with a
+// rate limit or server error code in the response envelope
+func (c *FelicityClient) withEnvelopeRetry(ctx context.Context, op string, call func() error) error {
+	attempts := max(c.Retry.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if attempt >= attempts || !transientEnvelopeError(err) {
+			return err
+		}
+
+		wait := c.Retry.delay(attempt, nil)
+		fmt.Printf("%s failed (attempt %d/%d): %v; retrying in %s\n", op, attempt, attempts, err, wait)
+		metrics.Retries.Add(1)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *FelicityClient) authorizedJSONOnce(ctx context.Context, op, method, path string, query url.Values, body interface{}, out apiEnvelope) ([]byte, error) {
+	req, err := c.newAuthorizedRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	accessToken := req.Header.Get("Authorization")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending %s request: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := apiErrorFromResponse(op, resp)
+		if errors.Is(apiErr, ErrTokenExpired) {
+			c.Tokens.Invalidate(accessToken)
+		}
+		return nil, apiErr
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return nil, fmt.Errorf("error decoding response body: %w", err)
+	}
+
+	if code, message := out.envelope(); code != apiCodeOK {
+		apiErr := &APIError{Op: op, StatusCode: resp.StatusCode, Code: code, Message: message}
+		if errors.Is(apiErr, ErrTokenExpired) {
+			c.Tokens.Invalidate(accessToken)
+		}
+		return nil, apiErr
+	}
+	return raw, nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient points a client at handler, retrying quickly so tests don't sleep
+func newTestClient(t *testing.T, handler http.HandlerFunc) *FelicityClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewFelicityClient(server.URL, nil, 5*time.Second)
+	client.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	return client
+}
+
+// writeEnvelope answers with the standard code/message envelope around data
+func writeEnvelope(w http.ResponseWriter, code int, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message, "data": data})
+}
+
+// testTokens hands out tokens in order, moving to the next one when the current one is invalidated
+type testTokens struct {
+	mu          sync.Mutex
+	tokens      []string
+	invalidated []string
+}
+
+func (s *testTokens) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[0], nil
+}
+
+func (s *testTokens) Invalidate(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidated = append(s.invalidated, accessToken)
+	if len(s.tokens) > 1 && s.tokens[0] == accessToken {
+		s.tokens = s.tokens[1:]
+	}
+}
+
+// memoryTokenStore is a TokenStore that keeps tokens in memory
+type memoryTokenStore struct {
+	tokens *StoredTokens
+}
+
+func (s *memoryTokenStore) Load() (*StoredTokens, error) { return s.tokens, nil }
+
+func (s *memoryTokenStore) Save(tokens *StoredTokens) error {
+	s.tokens = tokens
+	return nil
+}
+
+func TestAPIErrorIs(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *APIError
+		want error
+	}{
+		{"envelope token expired", &APIError{StatusCode: 200, Code: 998}, ErrTokenExpired},
+		{"envelope unauthorized", &APIError{StatusCode: 200, Code: 401}, ErrTokenExpired},
+		{"http unauthorized", &APIError{StatusCode: 401}, ErrTokenExpired},
+		{"envelope rate limited", &APIError{StatusCode: 200, Code: 429}, ErrRateLimited},
+		{"http rate limited", &APIError{StatusCode: 429}, ErrRateLimited},
+		{"envelope not found", &APIError{StatusCode: 200, Code: 404}, ErrDeviceNotFound},
+		{"http not found", &APIError{StatusCode: 404}, ErrDeviceNotFound},
+		{"envelope server error", &APIError{StatusCode: 200, Code: 503}, ErrServerError},
+		{"http server error", &APIError{StatusCode: 502}, ErrServerError},
+		{"other code", &APIError{StatusCode: 200, Code: 400}, nil},
+		{"kind takes precedence", &APIError{StatusCode: 401, Kind: ErrInvalidCredentials}, ErrInvalidCredentials},
+	}
+	sentinels := []error{ErrTokenExpired, ErrInvalidCredentials, ErrRateLimited, ErrDeviceNotFound, ErrServerError}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := fmt.Errorf("calling api: %w", tt.err)
+			for _, sentinel := range sentinels {
+				if got := errors.Is(wrapped, sentinel); got != (sentinel == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, sentinel, got, !got)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&APIError{StatusCode: 200, Code: 404}, http.StatusNotFound},
+		{&APIError{StatusCode: 429}, http.StatusTooManyRequests},
+		{&APIError{StatusCode: 200, Code: 998}, http.StatusBadGateway},
+		{&APIError{StatusCode: 200, Code: 400}, http.StatusBadGateway},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := httpStatusForError(tt.err); got != tt.want {
+			t.Errorf("httpStatusForError(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClientSendsConfiguredRequest(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openApi/data/deviceDataHistory/SN 1" {
+			t.Errorf("path = %q", r.URL.Path)
+		}
+		if got := r.URL.Query().Get("dateStr"); got != "2024-01-02" {
+			t.Errorf("dateStr = %q", got)
+		}
+		if got := r.Header.Get("Authorization"); got != "token-1" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("User-Agent"); got != "test-agent" {
+			t.Errorf("User-Agent = %q", got)
+		}
+		writeEnvelope(w, apiCodeOK, "ok", map[string]interface{}{"datalist": []interface{}{}})
+	})
+	client.UserAgent = "test-agent"
+	client.Tokens = &testTokens{tokens: []string{"token-1"}}
+
+	if _, err := client.FetchDeviceDataHistory(context.Background(), "SN 1", "2024-01-02", "1", "10"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshAccessToken(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/openApi/sec/refreshToken" {
+			t.Errorf("request = %s %s", r.Method, r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var request map[string]string
+		if err := json.Unmarshal(body, &request); err != nil || request["refreshToken"] != "refresh-1" {
+			t.Errorf("body = %q", body)
+		}
+		writeEnvelope(w, apiCodeOK, "ok", loginData("access-2", "refresh-2"))
+	})
+
+	tokens, err := client.RefreshAccessToken(context.Background(), "refresh-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken != "access-2" || tokens.RefreshToken != "refresh-2" {
+		t.Errorf("tokens = %+v, want access-2 and refresh-2", tokens)
+	}
+	if time.Until(tokens.AccessTokenExpiry) < 50*time.Minute {
+		t.Errorf("access token expires at %v, want about an hour from now", tokens.AccessTokenExpiry)
+	}
+}
+
+func TestTransportErrorsWrappedOnce(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	client.BaseURL = "http://127.0.0.1:0"
+	client.Retry.MaxAttempts = 1
+	client.Tokens = &testTokens{tokens: []string{"token"}}
+
+	_, refreshErr := client.RefreshAccessToken(context.Background(), "refresh-1")
+	_, loginErr := client.Login(context.Background(), "user", "secret")
+	_, historyErr := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10")
+	for _, err := range []error{refreshErr, loginErr, historyErr} {
+		if err == nil || strings.Count(err.Error(), "error sending") != 1 {
+			t.Errorf("error = %v, want one \"error sending ...\" prefix", err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int // HTTP status per attempt; success once they run out
+		codes     []int // envelope code per attempt, answered with HTTP 200
+		wantCalls int32
+		wantErr   bool
+		wantIs    error // sentinel the error should match, if any
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "server errors then success", responses: []int{503, 502}, wantCalls: 3},
+		{name: "server errors exhaust attempts", responses: []int{500, 500, 500}, wantCalls: 3, wantErr: true, wantIs: ErrServerError},
+		{name: "rate limited then success", responses: []int{429}, wantCalls: 2},
+		{name: "client error is not retried", responses: []int{400}, wantCalls: 1, wantErr: true},
+		{name: "envelope rate limit then success", codes: []int{429, 429}, wantCalls: 3},
+		{name: "envelope server error exhausts attempts", codes: []int{500, 500, 500}, wantCalls: 3, wantErr: true, wantIs: ErrServerError},
+		{name: "envelope not found is not retried", codes: []int{404}, wantCalls: 1, wantErr: true, wantIs: ErrDeviceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				n := int(calls.Add(1)) - 1
+				if n < len(tt.responses) {
+					w.WriteHeader(tt.responses[n])
+					writeEnvelope(w, tt.responses[n], http.StatusText(tt.responses[n]), nil)
+					return
+				}
+				if n < len(tt.codes) {
+					writeEnvelope(w, tt.codes[n], "failed", nil)
+					return
+				}
+				writeEnvelope(w, apiCodeOK, "ok", map[string]interface{}{"datalist": []interface{}{}})
+			})
+			client.Tokens = &testTokens{tokens: []string{"token"}}
+
+			_, err := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10")
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("server called %d times, want %d", got, tt.wantCalls)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantIs)
+			}
+		})
+	}
+}
+
+func TestRetryReplaysRequestBody(t *testing.T) {
+	var calls atomic.Int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var request map[string]string
+		if err := json.Unmarshal(body, &request); err != nil || request["refreshToken"] != "refresh-1" {
+			t.Errorf("attempt %d body = %q", calls.Load()+1, body)
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeEnvelope(w, apiCodeOK, "ok", loginData("access-2", "refresh-2"))
+	})
+
+	tokens, err := client.RefreshAccessToken(context.Background(), "refresh-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 || tokens.AccessToken != "access-2" {
+		t.Errorf("after %d calls got access token %q, want 2 calls and access-2", calls.Load(), tokens.AccessToken)
+	}
+}
+
+func TestRetryClientTimeout(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		writeEnvelope(w, apiCodeOK, "ok", map[string]interface{}{"datalist": []interface{}{}})
+	})
+	client.HTTPClient.Timeout = 50 * time.Millisecond
+	client.Tokens = &testTokens{tokens: []string{"token"}}
+
+	//the first attempt times out in the http.Client while the caller is still waiting
+	if _, err := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server called %d times, want 2", calls.Load())
+	}
+
+	//once the caller's own deadline passes there is nobody to retry for
+	calls.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.FetchDeviceDataHistory(ctx, "SN1", "2024-01-02", "1", "10")
+	if !errors.Is(err, context.DeadlineExceeded) || calls.Load() != 1 {
+		t.Errorf("error %v after %d calls, want DeadlineExceeded after 1", err, calls.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"3", 3 * time.Second, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+		{"-1", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = (%v, %v), want (%v, %v)", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	if got := policy.delay(1, resp); got != 2*time.Second {
+		t.Errorf("delay with Retry-After 2 = %v, want 2s", got)
+	}
+	resp.Header.Set("Retry-After", strconv.Itoa(int(time.Hour/time.Second)))
+	if got := policy.delay(1, resp); got != maxRetryAfter {
+		t.Errorf("delay with Retry-After 1h = %v, want %v", got, maxRetryAfter)
+	}
+}
+
+func TestLoginErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		codes     []int // envelope code per attempt; success once they run out
+		wantErr   error
+		wantCalls int32
+	}{
+		{name: "success", status: 200, wantCalls: 1},
+		{name: "wrong password in envelope", status: 200, codes: []int{401}, wantErr: ErrInvalidCredentials, wantCalls: 1},
+		{name: "forbidden in envelope", status: 200, codes: []int{403}, wantErr: ErrInvalidCredentials, wantCalls: 1},
+		{name: "http unauthorized", status: 401, codes: []int{401}, wantErr: ErrInvalidCredentials, wantCalls: 1},
+		{name: "rate limited in envelope is retried", status: 200, codes: []int{429}, wantCalls: 2},
+		{name: "server error in envelope is not a credentials failure", status: 200, codes: []int{500, 500, 500}, wantErr: ErrServerError, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/openApi/sec/login" {
+					t.Errorf("path = %q", r.URL.Path)
+				}
+				n := int(calls.Add(1)) - 1
+				if n < len(tt.codes) {
+					w.WriteHeader(tt.status)
+					writeEnvelope(w, tt.codes[n], "failed", nil)
+					return
+				}
+				writeEnvelope(w, apiCodeOK, "ok", loginData("access", "refresh"))
+			})
+
+			response, err := client.Login(context.Background(), "user", "secret")
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("server called %d times, want %d", got, tt.wantCalls)
+			}
+			if tt.wantErr == nil {
+				if err != nil || response.Data.AccessToken != "access" {
+					t.Fatalf("Login = %+v, %v; want access token", response, err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != ErrInvalidCredentials && errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("error %v is reported as invalid credentials", err)
+			}
+		})
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject func(w http.ResponseWriter) // how the server refuses the stale token
+	}{
+		{"envelope code 998", func(w http.ResponseWriter) { writeEnvelope(w, apiCodeTokenExpired, "token expired", nil) }},
+		{"http 401", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusUnauthorized)
+			writeEnvelope(w, 401, "unauthorized", nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				if r.Header.Get("Authorization") != "fresh" {
+					tt.reject(w)
+					return
+				}
+				writeEnvelope(w, apiCodeOK, "ok", map[string]interface{}{"datalist": []interface{}{}})
+			})
+			tokens := &testTokens{tokens: []string{"revoked", "fresh"}}
+			client.Tokens = tokens
+			replays := metrics.AuthReplays.Value()
+
+			if _, err := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10"); err != nil {
+				t.Fatal(err)
+			}
+			if calls.Load() != 2 {
+				t.Errorf("server called %d times, want 2", calls.Load())
+			}
+			if len(tokens.invalidated) != 1 || tokens.invalidated[0] != "revoked" {
+				t.Errorf("invalidated %v, want [revoked]", tokens.invalidated)
+			}
+			if got := metrics.AuthReplays.Value() - replays; got != 1 {
+				t.Errorf("AuthReplays went up by %d, want 1", got)
+			}
+		})
+	}
+
+	t.Run("replayed once only", func(t *testing.T) {
+		var calls atomic.Int32
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			writeEnvelope(w, apiCodeTokenExpired, "token expired", nil)
+		})
+		client.Tokens = &testTokens{tokens: []string{"revoked", "also-revoked", "never-used"}}
+
+		_, err := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10")
+		if !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("error = %v, want ErrTokenExpired", err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("server called %d times, want 2", calls.Load())
+		}
+	})
+}
+
+func TestTokenManagerRenewsRejectedToken(t *testing.T) {
+	var refreshes, logins atomic.Int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openApi/sec/refreshToken":
+			refreshes.Add(1)
+			writeEnvelope(w, apiCodeOK, "ok", loginData("refreshed", "refresh-2"))
+		case "/openApi/sec/login":
+			logins.Add(1)
+			writeEnvelope(w, apiCodeOK, "ok", loginData("logged-in", "refresh-3"))
+		default:
+			if r.Header.Get("Authorization") != "refreshed" {
+				writeEnvelope(w, apiCodeTokenExpired, "token expired", nil)
+				return
+			}
+			writeEnvelope(w, apiCodeOK, "ok", map[string]interface{}{"datalist": []interface{}{}})
+		}
+	})
+	store := &memoryTokenStore{tokens: &StoredTokens{
+		AccessToken:        "revoked",
+		RefreshToken:       "refresh-1",
+		AccessTokenExpiry:  time.Now().Add(time.Hour),
+		RefreshTokenExpiry: time.Now().Add(24 * time.Hour),
+	}}
+	client.Tokens = NewTokenManager(client, "user", "secret", store)
+
+	//concurrent callers hit the revoked token together and share one refresh
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.FetchDeviceDataHistory(context.Background(), "SN1", "2024-01-02", "1", "10")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if refreshes.Load() != 1 || logins.Load() != 0 {
+		t.Errorf("%d refreshes and %d logins, want 1 and 0", refreshes.Load(), logins.Load())
+	}
+	if store.tokens.AccessToken != "refreshed" {
+		t.Errorf("stored access token %q, want refreshed", store.tokens.AccessToken)
+	}
+}
+
+func TestTokenManagerForcedRenewalLogsIn(t *testing.T) {
+	var logins atomic.Int32
+	refreshing, release := make(chan struct{}), make(chan struct{})
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openApi/sec/refreshToken":
+			close(refreshing)
+			<-release
+			writeEnvelope(w, apiCodeOK, "ok", loginData("refreshed", "refresh-2"))
+		case "/openApi/sec/login":
+			logins.Add(1)
+			writeEnvelope(w, apiCodeOK, "ok", loginData("logged-in", "refresh-3"))
+		}
+	})
+	store := &memoryTokenStore{tokens: &StoredTokens{
+		AccessToken:        "expired",
+		RefreshToken:       "refresh-1",
+		RefreshTokenExpiry: time.Now().Add(24 * time.Hour),
+	}}
+	tm := NewTokenManager(client, "user", "secret", store)
+
+	//a plain renewal is refreshing when a forced one is requested
+	refreshed := make(chan string, 1)
+	go func() {
+		token, _ := tm.Token(context.Background())
+		refreshed <- token
+	}()
+	<-refreshing
+	forced := make(chan *StoredTokens, 1)
+	go func() {
+		tokens, err := tm.Renew(context.Background(), true)
+		if err != nil {
+			t.Error(err)
+		}
+		forced <- tokens
+	}()
+	for queued := false; !queued; time.Sleep(time.Millisecond) {
+		tm.mu.Lock()
+		queued = tm.inflight.next != nil
+		tm.mu.Unlock()
+	}
+	close(release)
+
+	if token := <-refreshed; token != "refreshed" {
+		t.Errorf("Token = %q, want refreshed", token)
+	}
+	if tokens := <-forced; tokens == nil || tokens.AccessToken != "logged-in" {
+		t.Errorf("forced Renew = %+v, want the logged-in tokens", tokens)
+	}
+	if logins.Load() != 1 {
+		t.Errorf("%d logins, want 1", logins.Load())
+	}
+}
+
+// loginData is the data of a successful login or refresh response
+func loginData(accessToken, refreshToken string) map[string]string {
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	return map[string]string{
+		"token":              accessToken,
+		"tokenExpireTime":    expiry,
+		"refreshToken":       refreshToken,
+		"refTokenExpireTime": expiry,
+	}
+}
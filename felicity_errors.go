@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sentinel errors for Felicity failures callers commonly need to tell apart.
+// Match them with errors.Is; use errors.As with *APIError for the raw code and message.
+var (
+	ErrTokenExpired       = errors.New("felicity: token expired or invalid")
+	ErrInvalidCredentials = errors.New("felicity: invalid credentials")
+	ErrRateLimited        = errors.New("felicity: rate limited")
+	ErrDeviceNotFound     = errors.New("felicity: device not found")
+	ErrServerError        = errors.New("felicity: server error")
+)
+
+// Felicity API response codes. 200 is success and 998 is returned once a token has expired;
+// the other failure codes in the envelope follow HTTP status numbering.
+const (
+	apiCodeOK           = 200
+	apiCodeUnauthorized = 401
+	apiCodeForbidden    = 403
+	apiCodeNotFound     = 404
+	apiCodeRateLimited  = 429
+	apiCodeServerError  = 500 // and the rest of the 5xx range
+	apiCodeTokenExpired = 998
+)
+
+// APIError is a failed Felicity call, either a non-200 HTTP status or a non-200 code in the
+// JSON envelope. Kind, when set, is the sentinel the failing endpoint attributes it to,
+// e.g. an unauthorized login is ErrInvalidCredentials rather than ErrTokenExpired.
+type APIError struct {
+	Op         string      // e.g. "login", "data history"
+	StatusCode int         // HTTP status code
+	Code       int         // API code from the response envelope, 0 if not decoded
+	Message    string      // API message
+	Data       interface{} // API data payload, could be string or object
+	Kind       error
+}
+
+func (e *APIError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%s API error: status=%d, code=%d, message=%s", e.Op, e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s request failed with status code: %d, message: %s, data: %v", e.Op, e.StatusCode, e.Message, e.Data)
+}
+
+// Is maps API codes and HTTP statuses onto the sentinel errors; an explicit Kind takes precedence
+func (e *APIError) Is(target error) bool {
+	if e.Kind != nil {
+		return target == e.Kind
+	}
+	switch target {
+	case ErrTokenExpired:
+		return e.Code == apiCodeTokenExpired || e.Code == apiCodeUnauthorized || e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return e.Code == apiCodeRateLimited || e.StatusCode == http.StatusTooManyRequests
+	case ErrDeviceNotFound:
+		return e.Code == apiCodeNotFound || e.StatusCode == http.StatusNotFound
+	case ErrServerError:
+		return (e.Code >= apiCodeServerError && e.Code < 600) || e.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// isAuthFailure reports whether a login was refused for its credentials
+func (e *APIError) isAuthFailure() bool {
+	return e.Code == apiCodeUnauthorized || e.Code == apiCodeForbidden ||
+		e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// transientEnvelopeError reports whether err is a rate limit or server error code inside an
+// HTTP 200 response. Failing HTTP statuses are already retried by doWithRetry.
+func transientEnvelopeError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusOK &&
+		(errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServerError))
+}
+
+// apiErrorFromResponse builds an APIError for a non-200 HTTP response, decoding the body when possible
+func apiErrorFromResponse(op string, resp *http.Response) *APIError {
+	apiErr := &APIError{Op: op, StatusCode: resp.StatusCode}
+
+	errorResponse := &ErrorResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(errorResponse); err != nil {
+		apiErr.Message = fmt.Sprintf("body decode error: %v", err)
+		return apiErr
+	}
+	apiErr.Code = errorResponse.Code
+	apiErr.Message = errorResponse.Message
+	apiErr.Data = errorResponse.Data
+	return apiErr
+}
+
+// httpStatusForError picks the status code our own API should answer with for a Felicity error
+func httpStatusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrTokenExpired), errors.Is(err, ErrInvalidCredentials):
+		// our upstream credentials are the problem, not the caller's request
+		return http.StatusBadGateway
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// respondError writes err as a JSON error with a status derived from its type
+func respondError(c *gin.Context, message string, err error) {
+	c.JSON(httpStatusForError(err), gin.H{"error": fmt.Sprintf("%s: %v", message, err)})
+}
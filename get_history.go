@@ -1,18 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math"
-	"net/http"
 	"net/url"
 	"strconv"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// DeviceData struct to represent only fields needed
+// DeviceData is one telemetry record from the deviceDataHistory endpoint. The typed fields
+// cover the metrics we store in columns; Raw keeps the complete record as received so
+// metrics without a column yet can be extracted later without re-fetching.
 type DeviceData struct {
 	DeviceSn       string `json:"deviceSn"`       // Device serial number
 	DeviceDataTime string `json:"deviceDataTime"` // Device data time string
@@ -21,6 +24,58 @@ type DeviceData struct {
 	EmsVoltage     string `json:"emsVoltage"`     // Battery Voltage (V)
 	AcOutputVolt   string `json:"acROutVolt"`     // AC Output Voltage (V)
 	AcOutputCurr   string `json:"acROutCurr"`     // AC Output Current (A)
+
+	Pv1Volt      string `json:"pv1Volt"`    // PV string 1 Voltage (V)
+	Pv1Curr      string `json:"pv1Curr"`    // PV string 1 Current (A)
+	Pv2Volt      string `json:"pv2Volt"`    // PV string 2 Voltage (V)
+	Pv2Curr      string `json:"pv2Curr"`    // PV string 2 Current (A)
+	AcInputVolt  string `json:"acRInVolt"`  // Grid Input Voltage (V)
+	AcInputCurr  string `json:"acRInCurr"`  // Grid Input Current (A)
+	AcInputFreq  string `json:"acRInFreq"`  // Grid Input Frequency (Hz)
+	AcOutputFreq string `json:"acROutFreq"` // AC Output Frequency (Hz)
+	EmsCurrent   string `json:"emsCurr"`    // Battery Current (A)
+	InverterTemp string `json:"invTemp"`    // Inverter Temperature (C)
+	DcTemp       string `json:"dcTemp"`     // DC-DC Temperature (C)
+	FaultCode    string `json:"faultCode"`  // Active fault code, empty or "0" when none
+	WarningCode  string `json:"warnCode"`   // Active warning code
+
+	Raw json.RawMessage `json:"-"` // complete record as returned by the API
+}
+
+// UnmarshalJSON decodes the typed fields and keeps a copy of the full record in Raw. Values
+// are taken leniently: numbers and booleans become their text and anything else that isn't
+// a string is dropped, so an endpoint sending a metric as a number doesn't fail the whole page.
+func (d *DeviceData) UnmarshalJSON(b []byte) error {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		switch v := value.(type) {
+		case string:
+		case json.Number:
+			fields[name] = v.String()
+		case bool:
+			fields[name] = strconv.FormatBool(v)
+		default:
+			delete(fields, name)
+		}
+	}
+	normalized, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	type plain DeviceData // no methods, so no recursion
+	var decoded plain
+	if err := json.Unmarshal(normalized, &decoded); err != nil {
+		return err
+	}
+	*d = DeviceData(decoded)
+	d.Raw = append(json.RawMessage(nil), b...)
+	return nil
 }
 
 // device data history response
@@ -36,15 +91,12 @@ type DeviceDataHistoryResponse struct {
 	} `json:"data"`
 }
 
+func (r *DeviceDataHistoryResponse) envelope() (int, string) { return r.Code, r.Message }
+
 const dbFileName = "device_data.db"
 
 // fetch historical device data for a single device
-func FetchDeviceDataHistory(deviceSn, dateStr, pageNum, pageSize, accessToken string) (*DeviceDataHistoryResponse, error) {
-	apiURL, err := url.Parse(baseURL + "/openApi/data/deviceDataHistory/" + deviceSn) //deviceSn added as a parameter
-	if err != nil {
-		return nil, fmt.Errorf("error parsing URL: %w", err)
-	}
-
+func (c *FelicityClient) FetchDeviceDataHistory(ctx context.Context, deviceSn, dateStr, pageNum, pageSize string) (*DeviceDataHistoryResponse, error) {
 	//fmt.Println(dateStr)
 
 	//add query params
@@ -52,171 +104,194 @@ func FetchDeviceDataHistory(deviceSn, dateStr, pageNum, pageSize, accessToken st
 	queryParams.Add("dateStr", dateStr)
 	queryParams.Add("pageNum", pageNum)
 	queryParams.Add("pageSize", pageSize)
-	apiURL.RawQuery = queryParams.Encode()
-
-	//fmt.Println("Request URL:", apiURL.String())
-
-	req, err := http.NewRequest("GET", apiURL.String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
-	}
-
-	//set authorization header
-	req.Header.Set("Authorization", accessToken)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		errorResponse := &ErrorResponse{}
-		decodeErr := json.NewDecoder(resp.Body).Decode(errorResponse)
-		if decodeErr != nil {
-			return nil, fmt.Errorf("data history request failed with status code: %d, and body decode error: %w", resp.StatusCode, decodeErr)
-		}
-		return nil, fmt.Errorf("data history request failed, status code: %d, message: %s, data: %+v", resp.StatusCode, errorResponse.Message, errorResponse.Data)
-	}
 
 	var responseData DeviceDataHistoryResponse
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&responseData); err != nil {
-		return nil, fmt.Errorf("error decoding response body: %w", err)
-	}
-
-	if responseData.Code != 200 {
-		return nil, fmt.Errorf("data history API error: code=%d, message=%s", responseData.Code, responseData.Message)
-	}
-
-	// ---- log to SQLite ----
-	db, err := openOrCreateDB() //open or create SQLite database
-	if err != nil {
-		fmt.Println("Error opening/creating database:", err)
-		return &responseData, nil
-	}
-	defer db.Close()
-
-	err = createDataTable(db) //create table if it doesn't exist
-	if err != nil {
-		fmt.Println("Error creating data table:", err)
-		return &responseData, nil
-	}
-
-	err = clearDeviceDataHistory(db)
+	raw, err := c.doAuthorizedJSON(ctx, "data history", "GET", "/openApi/data/deviceDataHistory/"+url.PathEscape(deviceSn), queryParams, nil, &responseData) //deviceSn added as a path parameter
 	if err != nil {
-		fmt.Println("Error during database clearing:", err)
+		return nil, err
 	}
-	fmt.Println("Device data history cleared successfully.")
 
-	err = logDataToDB(db, responseData.Data.DataList) //log data to database
-	if err != nil {
-		fmt.Println("Error logging data to database:", err)
+	//keep the untouched body so device_data can be rebuilt later (see reprocess)
+	if c.Archive != nil {
+		if err := c.Archive.Save(ctx, archiveEndpointDeviceDataHistory, deviceSn, queryParams, raw); err != nil {
+			fmt.Println("Error archiving data history response:", err)
+		}
 	}
 
 	return &responseData, nil
 }
 
-func clearDeviceDataHistory(db *sql.DB) error {
-	tx, err := db.Begin() //atomicity
-	if err != nil {
-		return fmt.Errorf("error starting transaction for clearing data: %v", err)
-	}
-	defer tx.Rollback() //rollback in case of errors
+// HistoryProgress describes how far a multi-page history fetch has got
+type HistoryProgress struct {
+	Page       int
+	TotalPages int
+	Rows       int // rows received so far
+	TotalRows  int // total reported by the API, 0 if unknown
+}
 
-	_, err = tx.Exec("DELETE FROM device_data")
-	if err != nil {
-		//fmt.Printf("error deleting data table: %v ---\n", err)
-		return fmt.Errorf("error clearing device data history: %w", err)
-	}
+// maxHistoryPages guards against looping forever if the API misreports totalPage
+const maxHistoryPages = 1000
 
-	//reset auto-increment sequence
-	_, err = tx.Exec("DELETE FROM sqlite_sequence WHERE name = 'device_data'")
-	if err != nil {
-		return fmt.Errorf("error resetting sequence for device_data: %v", err)
-	}
+// FetchAllDeviceDataHistory walks every page of a day's history using totalPage, calling fn
+// with each page's rows as they arrive. Returning an error from fn stops the walk.
+func (c *FelicityClient) FetchAllDeviceDataHistory(ctx context.Context, deviceSn, dateStr string, pageSize int, fn func(rows []DeviceData, progress HistoryProgress) error) error {
+	progress := HistoryProgress{}
 
-	if err = tx.Commit(); err != nil { //commit transaction is successful
-		return fmt.Errorf("error committing transaction: %v", err)
-	}
+	for page := 1; page <= maxHistoryPages; page++ {
+		response, err := c.FetchDeviceDataHistory(ctx, deviceSn, dateStr, strconv.Itoa(page), strconv.Itoa(pageSize))
+		if err != nil {
+			return fmt.Errorf("error fetching page %d: %w", page, err)
+		}
 
-	return nil
-}
+		rows := response.Data.DataList
+		progress.Page = page
+		progress.Rows += len(rows)
+		if totalPages, err := strconv.Atoi(response.Data.TotalPage); err == nil {
+			progress.TotalPages = totalPages
+		}
+		if totalRows, err := strconv.Atoi(response.Data.Total); err == nil {
+			progress.TotalRows = totalRows
+		}
 
-// openOrCreateDB opens or creates a SQLite db
-func openOrCreateDB() (*sql.DB, error) {
-	//fmt.Println("--- openOrCreateDB() called ---") // Debug print
+		if err := fn(rows, progress); err != nil {
+			return err
+		}
 
-	db, err := sql.Open("sqlite3", dbFileName)
-	if err != nil {
-		fmt.Printf("error opening data table: %v ---\n", err)
-		return nil, fmt.Errorf("error opening database: %w", err)
+		// stop at the reported last page, or on a short page when totalPage is missing
+		if progress.TotalPages > 0 {
+			if page >= progress.TotalPages {
+				return nil
+			}
+		} else if len(rows) < pageSize {
+			return nil
+		}
 	}
-	return db, nil
+	return fmt.Errorf("gave up after %d pages of device data history", maxHistoryPages)
 }
 
-// createDataTable create device data
-func createDataTable(db *sql.DB) error {
-	_, err := db.Exec(`
-			CREATE TABLE IF NOT EXISTS device_data (
-					id INTEGER PRIMARY KEY AUTOINCREMENT,
-					device_sn TEXT,
-					data_time TEXT,
-					pv_input_power_w REAL,
-					battery_power_w REAL,
-					battery_voltage_v REAL,
-					ac_output_voltage REAL,
-					ac_output_current REAL,
-					load_power_w REAL,
-					battery_percentage INTEGER,
-					log_time DATETIME DEFAULT CURRENT_TIMESTAMP
-					)	
-	`)
-	if err != nil {
-		fmt.Printf("error creating data table: %v ---\n", err)
-		return fmt.Errorf("error creating table: %w", err)
+// ingestDeviceDataHistory fetches every page of a device's history for dateStr and upserts
+// each page as it arrives, returning the number of rows stored.
+func ingestDeviceDataHistory(ctx context.Context, app *App, deviceSn, dateStr string) (int, error) {
+	stored := 0
+	err := app.Client.FetchAllDeviceDataHistory(ctx, deviceSn, dateStr, app.HistoryPageSize, func(rows []DeviceData, progress HistoryProgress) error {
+		if err := logDataToDB(app.DB, app.Store, app.Energy, rows); err != nil {
+			return fmt.Errorf("error logging data to database: %w", err)
+		}
+		stored += len(rows)
+		fmt.Printf("Device %s %s: page %d/%d stored, %d/%d rows\n", deviceSn, dateStr, progress.Page, progress.TotalPages, progress.Rows, progress.TotalRows)
+		return nil
+	})
+	return stored, err
+}
+
+// logDataToDB saves records to the store, recomputes the daily summaries of the days they fall on
+// and turns their fault codes into events in db. Only saving can fail the call: the records are
+// stored by the time summaries and events run, and refetching them wouldn't help those steps.
+func logDataToDB(db *sql.DB, store Store, energy EnergyOptions, dataList []DeviceData) error {
+	if err := store.SaveHistory(dataList); err != nil {
+		return err
+	}
+	if err := UpdateDailySummaries(store, energy, dataList); err != nil {
+		fmt.Println("Error updating daily summaries:", err)
+	}
+	if err := recordHistoryEvents(db, dataList); err != nil {
+		fmt.Println("Error recording events from history:", err)
 	}
 	return nil
 }
 
-// log data to DB
-func logDataToDB(db *sql.DB, dataList []DeviceData) error {
-	tx, err := db.Begin() //start transaction
+// SaveHistory upserts on (device_sn, data_time) so refetches are idempotent
+func (s *sqlStore) SaveHistory(dataList []DeviceData) error {
+	tx, err := s.db.Begin() //start transaction
 	if err != nil {
 		return fmt.Errorf("error starting transaction: %w", err)
 	}
 	defer tx.Rollback() //rollback if any errors
 
-	stmt, err := tx.Prepare(`
+	//TimescaleDB partitions on device_time, so it joins the unique key in place of data_time
+	timescale := s.dialect == dialectTimescale
+	timeColumn, timeValue, conflictKey := "", "", "device_sn, data_time"
+	if timescale {
+		timeColumn, timeValue, conflictKey = ", device_time", ", to_timestamp(?)", "device_sn, device_time"
+	}
+
+	stmt, err := tx.Prepare(s.bind(`
 		INSERT INTO device_data(
-			device_sn, data_time, pv_input_power_w, battery_power_w, battery_voltage_v, ac_output_voltage, ac_output_current, load_power_w, battery_percentage
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`)
+			device_sn, data_time, pv_input_power_w, battery_power_w, battery_voltage_v, ac_output_voltage, ac_output_current, load_power_w, battery_percentage,
+			pv1_voltage_v, pv1_current_a, pv2_voltage_v, pv2_current_a, grid_voltage_v, grid_current_a, grid_frequency_hz, ac_output_frequency_hz,
+			battery_current_a, inverter_temp_c, dc_temp_c, fault_code, warning_code, raw_json, data_ts` + timeColumn + `
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?` + timeValue + `)
+		ON CONFLICT(` + conflictKey + `) DO UPDATE SET
+			pv_input_power_w = excluded.pv_input_power_w,
+			battery_power_w = excluded.battery_power_w,
+			battery_voltage_v = excluded.battery_voltage_v,
+			ac_output_voltage = excluded.ac_output_voltage,
+			ac_output_current = excluded.ac_output_current,
+			load_power_w = excluded.load_power_w,
+			battery_percentage = excluded.battery_percentage,
+			pv1_voltage_v = excluded.pv1_voltage_v,
+			pv1_current_a = excluded.pv1_current_a,
+			pv2_voltage_v = excluded.pv2_voltage_v,
+			pv2_current_a = excluded.pv2_current_a,
+			grid_voltage_v = excluded.grid_voltage_v,
+			grid_current_a = excluded.grid_current_a,
+			grid_frequency_hz = excluded.grid_frequency_hz,
+			ac_output_frequency_hz = excluded.ac_output_frequency_hz,
+			battery_current_a = excluded.battery_current_a,
+			inverter_temp_c = excluded.inverter_temp_c,
+			dc_temp_c = excluded.dc_temp_c,
+			fault_code = excluded.fault_code,
+			warning_code = excluded.warning_code,
+			raw_json = excluded.raw_json,
+			data_ts = excluded.data_ts,
+			data_time = excluded.data_time,
+			log_time = CURRENT_TIMESTAMP
+	`))
 	if err != nil {
 		return fmt.Errorf("error preparing statement: %w", err)
 	}
 	defer stmt.Close()
 
 	for _, data := range dataList {
-		load := parseFloat(data.AcOutputCurr) * parseFloat(data.AcOutputVolt)
-		battery, err := CalibrateBatteryPercentage(db, parseFloat(data.EmsVoltage))
+		derived, err := deriveMetrics(s, data)
 		if err != nil {
-			return fmt.Errorf("error calcutaing battery percentage: %w", err)
+			return err
+		}
+		dataTs := deviceTimestamp(data.DeviceDataTime)
+		if timescale && dataTs == nil {
+			fmt.Printf("Skipping %s record with unparseable time %q\n", data.DeviceSn, data.DeviceDataTime)
+			continue
+		}
+		args := []interface{}{
+			data.DeviceSn,                    // device_sn TEXT
+			data.DeviceDataTime,              // data_time TEXT
+			optionalFloat(data.PvTotalPower), // pv_input_power_w REAL
+			optionalFloat(data.EmsPower),     // battery_power_w REAL
+			optionalFloat(data.EmsVoltage),   // battery_voltage_v REAL
+			optionalFloat(data.AcOutputVolt), // ac_output_voltage REAL
+			optionalFloat(data.AcOutputCurr), // ac_output_current REAL
+			derived.LoadPowerW,               // load_power_w REAL
+			derived.BatteryPercentage,        // battery_percentage INTEGER
+			optionalFloat(data.Pv1Volt),      // pv1_voltage_v REAL
+			optionalFloat(data.Pv1Curr),      // pv1_current_a REAL
+			optionalFloat(data.Pv2Volt),      // pv2_voltage_v REAL
+			optionalFloat(data.Pv2Curr),      // pv2_current_a REAL
+			optionalFloat(data.AcInputVolt),  // grid_voltage_v REAL
+			optionalFloat(data.AcInputCurr),  // grid_current_a REAL
+			optionalFloat(data.AcInputFreq),  // grid_frequency_hz REAL
+			optionalFloat(data.AcOutputFreq), // ac_output_frequency_hz REAL
+			optionalFloat(data.EmsCurrent),   // battery_current_a REAL
+			optionalFloat(data.InverterTemp), // inverter_temp_c REAL
+			optionalFloat(data.DcTemp),       // dc_temp_c REAL
+			data.FaultCode,                   // fault_code TEXT
+			data.WarningCode,                 // warning_code TEXT
+			string(data.Raw),                 // raw_json TEXT
+			dataTs,                           // data_ts INTEGER
+		}
+		if timescale {
+			args = append(args, dataTs) // device_time TIMESTAMPTZ
 		}
-		load_power_w := roundFloat(load, 2)
-		//battery_percentage := int(roundFloat(battery, 2))
-		_, err = stmt.Exec(
-			data.DeviceSn,                 // device_sn TEXT
-			data.DeviceDataTime,           // data_time TEXT
-			parseFloat(data.PvTotalPower), // pv_input_power_w REAL
-			parseFloat(data.EmsPower),     // battery_power_w REAL
-			parseFloat(data.EmsVoltage),   // battery_voltage_v REAL
-			parseFloat(data.AcOutputVolt), // ac_output_voltage REAL
-			parseFloat(data.AcOutputCurr), // ac_output_current REAL
-			load_power_w,                  //load_power_w REAL
-			battery,                       //battery_percentage INTEGER
-		)
+		_, err = stmt.Exec(args...)
 		if err != nil {
 			return fmt.Errorf("error inserting data row: %w", err)
 		}
@@ -228,6 +303,31 @@ func logDataToDB(db *sql.DB, dataList []DeviceData) error {
 	return nil
 }
 
+// DerivedMetrics are values computed from a record rather than reported by the inverter;
+// nil when the record lacks an input
+type DerivedMetrics struct {
+	LoadPowerW        *float64 // AC output voltage x current
+	BatteryPercentage *int     // from battery voltage via the calibration curve
+}
+
+// deriveMetrics computes the derived fields stored alongside every record
+func deriveMetrics(calibrations CalibrationStore, data DeviceData) (DerivedMetrics, error) {
+	var derived DerivedMetrics
+	current, voltage := optionalFloat(data.AcOutputCurr), optionalFloat(data.AcOutputVolt)
+	if current != nil && voltage != nil {
+		load := roundFloat(*current**voltage, 2)
+		derived.LoadPowerW = &load
+	}
+	if batteryVoltage := optionalFloat(data.EmsVoltage); batteryVoltage != nil {
+		battery, err := CalibrateBatteryPercentage(calibrations, *batteryVoltage)
+		if err != nil {
+			return DerivedMetrics{}, fmt.Errorf("error calcutaing battery percentage: %w", err)
+		}
+		derived.BatteryPercentage = &battery
+	}
+	return derived, nil
+}
+
 // parseFloat is a helper function to parse string to float64 safely.
 func parseFloat(s string) float64 {
 	if s == "" {
@@ -241,6 +341,20 @@ func parseFloat(s string) float64 {
 	return f
 }
 
+// optionalFloat parses a reported metric, giving nil (stored as NULL) when the record doesn't
+// carry it, so a missing reading isn't mistaken for a zero one
+func optionalFloat(s string) *float64 {
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		fmt.Printf("Warning: Could not parse float: %s, error: %v.  Storing NULL\n", s, err)
+		return nil
+	}
+	return &f
+}
+
 func roundFloat(val float64, precision int) float64 {
 	ratio := math.Pow(10, float64(precision))
 	return math.Round(val*ratio) / ratio
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// historyServer serves pages of history for any device and date from pages, one slice per page.
+// With reportTotal false the response leaves total and totalPage out.
+func historyServer(t *testing.T, pages [][]map[string]interface{}, reportTotal bool, calls *atomic.Int32) *FelicityClient {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		page, err := strconv.Atoi(r.URL.Query().Get("pageNum"))
+		if err != nil || page < 1 {
+			t.Errorf("pageNum = %q", r.URL.Query().Get("pageNum"))
+			return
+		}
+		data := map[string]interface{}{"datalist": []interface{}{}, "currentPage": strconv.Itoa(page)}
+		if page <= len(pages) {
+			data["datalist"] = pages[page-1]
+		}
+		if reportTotal {
+			total := 0
+			for _, rows := range pages {
+				total += len(rows)
+			}
+			data["total"] = strconv.Itoa(total)
+			data["totalPage"] = strconv.Itoa(len(pages))
+		}
+		writeEnvelope(w, apiCodeOK, "ok", data)
+	})
+	client.Tokens = &testTokens{tokens: []string{"token"}}
+	return client
+}
+
+func historyRow(deviceTime string, pv interface{}) map[string]interface{} {
+	return map[string]interface{}{"deviceSn": "SN1", "deviceDataTime": deviceTime, "pvTotalPower": pv}
+}
+
+func TestFetchAllDeviceDataHistory(t *testing.T) {
+	pages := [][]map[string]interface{}{
+		{historyRow("2024-01-02 10:00:00", "1"), historyRow("2024-01-02 10:05:00", "2")},
+		{historyRow("2024-01-02 10:10:00", "3"), historyRow("2024-01-02 10:15:00", "4")},
+		{historyRow("2024-01-02 10:20:00", "5")},
+	}
+	tests := []struct {
+		name        string
+		pages       [][]map[string]interface{}
+		reportTotal bool
+		wantCalls   int32
+	}{
+		{"follows totalPage", pages, true, 3},
+		{"stops on a short page without totalPage", pages, false, 3},
+		{"full last page without totalPage needs one more call", pages[:2], false, 3},
+		{"single page", pages[2:], true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			client := historyServer(t, tt.pages, tt.reportTotal, &calls)
+
+			var rows []DeviceData
+			var last HistoryProgress
+			err := client.FetchAllDeviceDataHistory(context.Background(), "SN1", "2024-01-02", 2, func(page []DeviceData, progress HistoryProgress) error {
+				rows = append(rows, page...)
+				last = progress
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRows := 0
+			for _, page := range tt.pages {
+				wantRows += len(page)
+			}
+			if calls.Load() != tt.wantCalls || len(rows) != wantRows || last.Rows != wantRows {
+				t.Errorf("%d calls, %d rows (progress %+v); want %d calls, %d rows", calls.Load(), len(rows), last, tt.wantCalls, wantRows)
+			}
+			if tt.reportTotal && (last.TotalPages != len(tt.pages) || last.TotalRows != wantRows) {
+				t.Errorf("progress %+v, want %d pages and %d rows in total", last, len(tt.pages), wantRows)
+			}
+		})
+	}
+
+	t.Run("callback error stops the walk", func(t *testing.T) {
+		var calls atomic.Int32
+		client := historyServer(t, pages, true, &calls)
+		stop := errors.New("stop")
+		err := client.FetchAllDeviceDataHistory(context.Background(), "SN1", "2024-01-02", 2, func([]DeviceData, HistoryProgress) error {
+			return stop
+		})
+		if !errors.Is(err, stop) || calls.Load() != 1 {
+			t.Errorf("error %v after %d calls, want stop after 1", err, calls.Load())
+		}
+	})
+}
+
+func TestIngestDeviceDataHistoryUpserts(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := MigrateUp(db, dialectSQLite); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{DB: db, Store: NewSQLiteStore(db), HistoryPageSize: 2, Energy: EnergyOptions{MaxGap: 15 * time.Minute}}
+
+	ingest := func(pages [][]map[string]interface{}) int {
+		t.Helper()
+		var calls atomic.Int32
+		app.Client = historyServer(t, pages, true, &calls)
+		stored, err := ingestDeviceDataHistory(context.Background(), app, "SN1", "2024-01-02")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+
+	//a numeric metric and a missing one must not fail the page
+	first := ingest([][]map[string]interface{}{
+		{historyRow("2024-01-02 10:00:00", 100), historyRow("2024-01-02 10:05:00", "200")},
+		{{"deviceSn": "SN1", "deviceDataTime": "2024-01-02 10:10:00"}},
+	})
+	//refetching overlaps the stored rows and corrects one of them
+	second := ingest([][]map[string]interface{}{
+		{historyRow("2024-01-02 10:05:00", "250"), historyRow("2024-01-02 10:15:00", "400")},
+	})
+	if first != 3 || second != 2 {
+		t.Errorf("stored %d then %d rows, want 3 then 2", first, second)
+	}
+
+	page, err := app.Store.HistoryPage(HistoryQuery{DeviceSn: "SN1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ time, pv string }{
+		{"2024-01-02 10:00:00", "100"},
+		{"2024-01-02 10:05:00", "250"},
+		{"2024-01-02 10:10:00", ""},
+		{"2024-01-02 10:15:00", "400"},
+	}
+	if page.Total != len(want) || len(page.Rows) != len(want) {
+		t.Fatalf("%d rows stored (%d returned), want %d", page.Total, len(page.Rows), len(want))
+	}
+	for i, row := range page.Rows {
+		if row.LocalTime != want[i].time || row.PvTotalPower != want[i].pv {
+			t.Errorf("row %d = %s pv %q, want %s pv %q", i, row.LocalTime, row.PvTotalPower, want[i].time, want[i].pv)
+		}
+	}
+}
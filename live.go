@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// realtimeDataPath is the open API endpoint for a device's current readings
+const realtimeDataPath = "/openApi/data/deviceRealTimeData/"
+
+// device realtime data response
+type DeviceRealtimeResponse struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    DeviceData `json:"data"`
+}
+
+func (r *DeviceRealtimeResponse) envelope() (int, string) { return r.Code, r.Message }
+
+// FetchRealtimeData fetches the device's latest readings
+func (c *FelicityClient) FetchRealtimeData(ctx context.Context, deviceSn string) (*DeviceData, error) {
+	var responseData DeviceRealtimeResponse
+	_, err := c.doAuthorizedJSON(ctx, "realtime data", "GET", realtimeDataPath+url.PathEscape(deviceSn), nil, nil, &responseData)
+	if err != nil {
+		return nil, err
+	}
+	if responseData.Data.DeviceSn == "" {
+		responseData.Data.DeviceSn = deviceSn
+	}
+	return &responseData.Data, nil
+}
+
+// LiveSnapshot is the current state of a device with the same derived fields as stored
+// history, keyed like the device_data columns. Metrics the device didn't report are null.
+type LiveSnapshot struct {
+	DeviceSn          string          `json:"device_sn"`
+	DataTime          string          `json:"data_time"`
+	PvInputPowerW     *float64        `json:"pv_input_power_w"`
+	BatteryPowerW     *float64        `json:"battery_power_w"`
+	BatteryVoltageV   *float64        `json:"battery_voltage_v"`
+	AcOutputVoltage   *float64        `json:"ac_output_voltage"`
+	AcOutputCurrent   *float64        `json:"ac_output_current"`
+	LoadPowerW        *float64        `json:"load_power_w"`
+	BatteryPercentage *int            `json:"battery_percentage"`
+	FetchedAt         time.Time       `json:"fetched_at"`
+	Cached            bool            `json:"cached"`
+	Raw               json.RawMessage `json:"raw,omitempty"`
+}
+
+// LiveCache fetches realtime snapshots and reuses them for ttl so dashboards polling
+// /live don't each hit the Felicity API. Concurrent misses for a device share one fetch.
+type LiveCache struct {
+	store  CalibrationStore
+	client *FelicityClient
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	snapshots map[string]LiveSnapshot
+	inflight  map[string]*liveCall
+}
+
+// liveCall tracks a fetch in progress so concurrent callers can wait on it
+type liveCall struct {
+	done     chan struct{}
+	snapshot LiveSnapshot
+	err      error
+}
+
+func NewLiveCache(store CalibrationStore, client *FelicityClient, ttl time.Duration) *LiveCache {
+	return &LiveCache{
+		store:     store,
+		client:    client,
+		ttl:       ttl,
+		snapshots: make(map[string]LiveSnapshot),
+		inflight:  make(map[string]*liveCall),
+	}
+}
+
+// Get returns a snapshot no older than ttl, fetching a new one when needed
+func (lc *LiveCache) Get(ctx context.Context, deviceSn string) (LiveSnapshot, error) {
+	lc.mu.Lock()
+	cached, ok := lc.snapshots[deviceSn]
+	if ok && time.Since(cached.FetchedAt) < lc.ttl {
+		lc.mu.Unlock()
+		cached.Cached = true
+		return cached, nil
+	}
+	call := lc.inflight[deviceSn]
+	if call == nil {
+		call = &liveCall{done: make(chan struct{})}
+		lc.inflight[deviceSn] = call
+		//the fetch runs detached so one caller giving up doesn't fail the others
+		go lc.fetch(call, deviceSn)
+	}
+	lc.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.snapshot, call.err
+	case <-ctx.Done():
+		return LiveSnapshot{}, ctx.Err()
+	}
+}
+
+// fetch loads a fresh snapshot into the cache and completes call
+func (lc *LiveCache) fetch(call *liveCall, deviceSn string) {
+	//not tied to any caller's context; the client timeout bounds the call
+	snapshot, err := lc.load(context.Background(), deviceSn)
+
+	lc.mu.Lock()
+	if err == nil {
+		lc.snapshots[deviceSn] = snapshot
+	}
+	delete(lc.inflight, deviceSn)
+	lc.mu.Unlock()
+
+	call.snapshot = snapshot
+	call.err = err
+	close(call.done)
+}
+
+func (lc *LiveCache) load(ctx context.Context, deviceSn string) (LiveSnapshot, error) {
+	data, err := lc.client.FetchRealtimeData(ctx, deviceSn)
+	if err != nil {
+		return LiveSnapshot{}, err
+	}
+	derived, err := deriveMetrics(lc.store, *data)
+	if err != nil {
+		return LiveSnapshot{}, err
+	}
+
+	return LiveSnapshot{
+		DeviceSn:          deviceSn,
+		DataTime:          isoDeviceTime(data.DeviceDataTime),
+		PvInputPowerW:     optionalFloat(data.PvTotalPower),
+		BatteryPowerW:     optionalFloat(data.EmsPower),
+		BatteryVoltageV:   optionalFloat(data.EmsVoltage),
+		AcOutputVoltage:   optionalFloat(data.AcOutputVolt),
+		AcOutputCurrent:   optionalFloat(data.AcOutputCurr),
+		LoadPowerW:        derived.LoadPowerW,
+		BatteryPercentage: derived.BatteryPercentage,
+		FetchedAt:         time.Now(),
+		Raw:               data.Raw,
+	}, nil
+}
+
+// LiveHandler serves GET /api/devices/:sn/live
+func LiveHandler(app *App, lc *LiveCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sn := c.Param("sn")
+		if !app.HasDevice(sn) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown device %s", sn)})
+			return
+		}
+
+		snapshot, err := lc.Get(c.Request.Context(), sn)
+		if err != nil {
+			respondError(c, "Error fetching live data", err)
+			return
+		}
+		c.JSON(http.StatusOK, snapshot)
+	}
+}
@@ -1,28 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 )
 
-const baseURL = "https://shine-api.felicitysolar.com" // Base URL from documentation
 const publicKeyStr = "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBAK0GDivaRzIKeTmQnAxAYh2LChuHWDp0yHZ0zIvm+Eoi7J+rx7phqR7EtkBDO3HWqAXVkNDeeQaU32P5w1Q4FVUCAwEAAQ=="
-const tokenFile = "tokens.json"
 
 // login request struct
 type LoginRequest struct {
@@ -95,12 +92,18 @@ func RSAEncrypt(plainText string) (string, error) {
 
 }
 
-func Login(username, password string) (*LoginResponse, error) {
-	apiURL, err := url.Parse(baseURL + "/openApi/sec/login")
-	if err != nil {
-		return nil, fmt.Errorf("error pasrsing URL: %w", err)
-	}
+// Login exchanges the account credentials for tokens, retrying transient envelope failures
+func (c *FelicityClient) Login(ctx context.Context, username, password string) (*LoginResponse, error) {
+	var response *LoginResponse
+	err := c.withEnvelopeRetry(ctx, "login", func() error {
+		var err error
+		response, err = c.loginOnce(ctx, username, password)
+		return err
+	})
+	return response, err
+}
 
+func (c *FelicityClient) loginOnce(ctx context.Context, username, password string) (*LoginResponse, error) {
 	encryptedPassword, err := RSAEncrypt(password)
 	if err != nil {
 		return nil, fmt.Errorf("password encrpytion error: %w", err)
@@ -112,31 +115,23 @@ func Login(username, password string) (*LoginResponse, error) {
 		Password: encryptedPassword,
 	}
 
-	requestBodyBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling request body: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewBuffer(requestBodyBytes))
+	req, err := c.newRequest(ctx, "POST", "/openApi/sec/login", nil, requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("error creating login request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %w", err)
+		return nil, fmt.Errorf("error sending login request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		errorResponse := &ErrorResponse{}
-		decoderErr := json.NewDecoder(resp.Body).Decode(errorResponse)
-		if decoderErr != nil {
-			return nil, fmt.Errorf("login request failed with status code: %d, and body decode error: %w", resp.StatusCode, decoderErr)
+		apiErr := apiErrorFromResponse("login", resp)
+		if apiErr.isAuthFailure() {
+			apiErr.Kind = ErrInvalidCredentials
 		}
-		return nil, fmt.Errorf("login request failed, status code: %d, message: %s, data: %v", resp.StatusCode, errorResponse.Message, errorResponse.Data)
+		return nil, apiErr
 	}
 
 	var responseData LoginResponse
@@ -145,8 +140,13 @@ func Login(username, password string) (*LoginResponse, error) {
 		return nil, fmt.Errorf("error decoding response body: %w", err)
 	}
 
-	if responseData.Code != 200 { // Check API-specific error code
-		return nil, fmt.Errorf("login API error: code=%d, message=%s", responseData.Code, responseData.Message)
+	if responseData.Code != apiCodeOK { // Check API-specific error code
+		//the login endpoint answers bad username/password with an error code in the envelope
+		apiErr := &APIError{Op: "login", StatusCode: resp.StatusCode, Code: responseData.Code, Message: responseData.Message}
+		if apiErr.isAuthFailure() {
+			apiErr.Kind = ErrInvalidCredentials
+		}
+		return nil, apiErr
 	}
 
 	//fmt.Println(&responseData)
@@ -154,60 +154,65 @@ func Login(username, password string) (*LoginResponse, error) {
 	return &responseData, nil
 }
 
-func saveTokensToFile(tokens *StoredTokens) error {
-	tokenJSON, err := json.MarshalIndent(tokens, "", "  ") // Pretty JSON formatting
-	if err != nil {
-		return fmt.Errorf("error marshaling tokens to JSON: %w", err)
+// func fetchDataAndStore() error {
+
+// }
+
+func main() {
+	//migrate works on the database alone, so it runs before the app (and its automatic migration) starts
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	err = os.WriteFile(tokenFile, tokenJSON, 0600) // 0600: read/write for owner only (secure file permissions)
+
+	app, err := NewApp()
 	if err != nil {
-		return fmt.Errorf("error writing tokens to file: %w", err)
+		log.Fatal(err)
 	}
-	return nil
-}
+	defer app.Close()
 
-func loadTokensFromFile() (*StoredTokens, error) {
-	tokenJSON, err := os.ReadFile(tokenFile)
-	if err != nil {
-		if os.IsNotExist(err) { // File doesn't exist - that's OK on first run
-			return nil, nil // Return nil tokens, no error
+	//subcommands (backfill, ...) run once and exit instead of serving
+	if len(os.Args) > 1 {
+		if err := runCommand(app, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		return nil, fmt.Errorf("error reading tokens from file: %w", err)
+		return
 	}
 
-	var tokens StoredTokens
-	err = json.Unmarshal(tokenJSON, &tokens)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling tokens from JSON: %w", err)
+	//without DEVICE_SNS/DEVICE_SN, ingest every device on the account
+	if err := app.ensureDevices(); err != nil {
+		log.Fatal(err)
 	}
-	return &tokens, nil
-}
 
-// func fetchDataAndStore() error {
+	db := app.DB
 
-// }
+	//keep tokens warm so a quiet spell doesn't leave us with an expired refresh token
+	tokenRefresher := NewTokenRefresher(app.Tokens,
+		envDuration("TOKEN_REFRESH_LEAD", 5*time.Minute),
+		envDuration("TOKEN_RELOGIN_LEAD", time.Hour),
+	)
+	go tokenRefresher.Run(context.Background())
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file:", err)
+	//refresh model/firmware/plant metadata for configured devices without delaying startup
+	if !app.discovered {
+		go func() {
+			if _, err := DiscoverDevices(context.Background(), db, app.Client); err != nil {
+				fmt.Println("Error refreshing device metadata:", err)
+			}
+		}()
 	}
 
-	username := os.Getenv("USERNAME")
-	password := os.Getenv("PASSWORD")
-	deviceSN := os.Getenv("DEVICE_SN")
+	//scheduled ingestion; POLL_INTERVAL sets how often today's history is fetched
+	poller := NewPoller(app, envDuration("POLL_INTERVAL", 5*time.Minute))
+	go poller.Run(context.Background())
 
-	if username == "" || password == "" || deviceSN == "" {
-		log.Fatal("USERNAME, PASSWORD and DEVICE_SN must be set in .env file") // Ensure variables are set
+	backfiller := NewBackfiller(app)
+	if err := backfiller.ResumePending(); err != nil {
+		fmt.Println("Error resuming backfill:", err)
 	}
 
-	//open db
-	db, err := sql.Open("sqlite3", "device_data.db")
-	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
-	}
-	defer db.Close()
-
 	router := gin.Default()
 
 	// serve static frontend files (HTML, CSS, JS)
@@ -221,107 +226,21 @@ func main() {
 	})
 
 	router.POST("api/run_main", func(c *gin.Context) {
-		//attempt to load tokens from file on startup
-		storedTokens, err := loadTokensFromFile()
-		if err != nil {
-			fmt.Println("Error loading tokens from file:", err)
-		}
-
-		if storedTokens == nil || storedTokens.AccessToken == "" {
-			// no tokens in file or loading failed -login then
-			err := performLogin(username, password)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Initial login failed: %v", err)})
-				return
-			}
-			storedTokens, _ = loadTokensFromFile()
-			if storedTokens == nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens after initial login"})
-			}
-
-		}
-		accessToken := storedTokens.AccessToken // Assign values if loaded from file
-		//refreshToken := storedTokens.RefreshToken             // Assign values if loaded from file
-		accessTokenExpiry := storedTokens.AccessTokenExpiry   // Assign expiry times if loaded from file
-		refreshTokenExpiry := storedTokens.RefreshTokenExpiry // Assign expiry times if loaded from file
-
-		//check if access token is expired or about to expire
-		if time.Now().Add(time.Minute).After(accessTokenExpiry) {
-			//check if refresh token is also expired
-			if time.Now().After(refreshTokenExpiry) {
-				fmt.Println("Access token and refresh token are expired. Please login again.")
-				//clear stored tokens to force new login
-				emptyTokens := &StoredTokens{}
-				saveTokensToFile(emptyTokens)
-				fmt.Println("Attempting to login again...")
-				err := performLogin(username, password)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Automatic login failed: %v", err)})
-					//handle login failure - maybe exit or retry after a delay
-					return
-				}
-				storedTokens, _ = loadTokensFromFile()
-				if storedTokens == nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens after automatic login"})
-					return
-				}
-				accessToken = storedTokens.AccessToken
-			}
-		} else {
-
-			fmt.Println("Access token expired, attempting refresh.")
-			newAccessToken, newRefreshToken, newAccessTokenExpiry, newRefreshTokenExpiry, refreshErr := RefreshAccessToken()
-			if refreshErr != nil {
-				fmt.Println("Refresh failed:", refreshErr)
-				fmt.Println("Attempting to log in again...")
-				// Clear stored tokens
-				emptyTokens := &StoredTokens{}
-				saveTokensToFile(emptyTokens)
-				err := performLogin(username, password) // Call a helper function for login
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Automatic login failed after refresh failure: %v", err)})
-					// Handle login failure
-					return
-				}
-				storedTokens, _ = loadTokensFromFile()
-				if storedTokens == nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens after login after refresh failure"})
-					return
-				}
-				accessToken = storedTokens.AccessToken
-			} else {
-				fmt.Println("Access token refreshed successfully.")
-				//update stored tokens with new access token and maybe new refresh token
-				newStoredTokens := &StoredTokens{
-					AccessToken:        newAccessToken,
-					RefreshToken:       newRefreshToken,
-					AccessTokenExpiry:  newAccessTokenExpiry,
-					RefreshTokenExpiry: newRefreshTokenExpiry,
-				}
-				saveTokensToFile(newStoredTokens)
-				accessToken = newAccessToken
-			}
-
-		}
-		//fetch device data history
+		//fetch device data history through the poller so a manual fetch can't overlap a scheduled one
 		fmt.Println("\n--- Fetching Device Data History ---")
-		currentTime := time.Now()
-		dateStr := currentTime.Format("2006-01-02")
-		//dateStr := "2025-04-03"
-		//targetTime := time.Date(2025, time.February, 20, 12, 0, 0, 0, time.UTC)
-		//dateStr := targetTime.Format("2006-01-02-15:04:05")
-		pageNum := "1"
-		pageSize := "10"
-
-		_, dataErr := FetchDeviceDataHistory(deviceSN, dateStr, pageNum, pageSize, accessToken)
+		stored, dataErr := poller.PollOnce(c.Request.Context())
+		if errors.Is(dataErr, ErrPollInProgress) {
+			c.JSON(http.StatusConflict, gin.H{"error": dataErr.Error()})
+			return
+		}
 		if dataErr != nil {
 			fmt.Println("Error fetching device data history:", dataErr)
-		} else {
-			fmt.Println("Device Data History Fetch Successful!")
-
+			respondError(c, "Error fetching device data history", dataErr)
+			return
 		}
+		fmt.Printf("Device Data History Fetch Successful! %d rows stored.\n", stored)
 
-		history, err := GetAllDeviceHistory(db)
+		history, err := app.Store.AllHistory(c.Query("device_sn"), TimeRange{})
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching data from database"})
 			return
@@ -329,9 +248,14 @@ func main() {
 		c.JSON(http.StatusOK, history)
 	})
 
-	//API endpoint to get history
+	//API endpoint to get history, optionally for one device (?device_sn=) and time range (?from=&to= or ?date=)
 	router.GET("/api/history", func(c *gin.Context) {
-		history, err := GetAllDeviceHistory(db)
+		timeRange, err := historyTimeRange(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		history, err := app.Store.AllHistory(c.Query("device_sn"), timeRange)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching device from database"})
 			return
@@ -340,24 +264,36 @@ func main() {
 	})
 
 	//API endpoint to get history with filtering and pagination
-	router.GET("/api/history/filtered", func(c *gin.Context) {
-		dateStr := c.Query("date")
-		pageSizeStr := c.Query("pageSize")
-		pageNumStr := c.Query("pageNum")
+	router.GET("/api/history/filtered", FilteredHistoryHandler(app.Store, ""))
 
-		history, err := GetDeviceHistory(db, dateStr, pageNumStr, pageSizeStr)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching filtered data from database"})
-			return
-		}
-		c.JSON(http.StatusOK, history)
-	})
+	//API endpoint to get history downsampled into buckets (?interval=15m|1h|1d&fields=&fn=avg|min|max|last)
+	router.GET("/api/history/aggregate", AggregateHistoryHandler(app.Store))
+
+	//API endpoint to get energy totals in kWh per device and day, month or year
+	router.GET("/api/energy", EnergyHandler(app.Store, app.Energy))
+
+	//API endpoint to get the stored daily summaries (?from=&to= or ?date=, YYYY-MM-DD)
+	router.GET("/api/summary/daily", DailySummaryHandler(app.Store))
+
+	//API endpoints to list devices, refresh their metadata from the account and get one device's history
+	router.GET("/api/devices", DevicesHandler(app))
+	router.POST("/api/devices/discover", DiscoverDevicesHandler(app))
+	router.GET("/api/devices/:sn/history", DeviceHistoryHandler(app))
 
-	router.POST("/api/calibrate_battery", CalibrateBatteryHandler(db))
+	//API endpoint for a device's current readings, cached for LIVE_CACHE_TTL
+	liveCache := NewLiveCache(app.Store, app.Client, envDuration("LIVE_CACHE_TTL", 30*time.Second))
+	router.GET("/api/devices/:sn/live", LiveHandler(app, liveCache))
+
+	//API endpoint to list inverter alarms and faults, filtered by device_sn, severity, from and to
+	router.GET("/api/events", EventsHandler(db))
+
+	//calibration changes re-derive the stored battery percentages in the background
+	recalibrator := NewRecalibrator(app.Store, app.Energy)
+	router.POST("/api/calibrate_battery", CalibrateBatteryHandler(app.Store, recalibrator))
 
 	//API endpoint to get calibration history
 	router.GET("/api/calibration_data", func(c *gin.Context) {
-		history, err := GetCalibrationHistory(db)
+		history, err := app.Store.Calibrations()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching calibration data from database"})
 			return
@@ -366,7 +302,30 @@ func main() {
 	})
 	//router.GET("/api/calibration_data", GetCalibrationDataHandler(db))
 
-	router.PUT("/api/calibration_data/:id", UpdateCalibrationDataHandler(db))
+	router.PUT("/api/calibration_data/:id", UpdateCalibrationDataHandler(app.Store, recalibrator))
+
+	//API endpoint to follow the background re-derivation after a calibration change
+	router.GET("/api/calibration_data/recalibration", func(c *gin.Context) {
+		c.JSON(http.StatusOK, recalibrator.Status())
+	})
+
+	//API endpoints to start a historical backfill and follow its progress
+	router.POST("/api/backfill", StartBackfillHandler(backfiller))
+	router.GET("/api/backfill", BackfillStatusHandler(backfiller))
+
+	//API endpoints to inspect, pause and resume the scheduled poller
+	router.GET("/api/poller/status", PollerStatusHandler(poller))
+	router.POST("/api/poller/pause", PollerPauseHandler(poller, true))
+	router.POST("/api/poller/resume", PollerPauseHandler(poller, false))
+
+	//admin-only endpoints, require X-Admin-Token matching ADMIN_TOKEN
+	admin := router.Group("/api/admin", AdminAuth(os.Getenv("ADMIN_TOKEN")))
+	admin.DELETE("/device_data", ClearDeviceDataHandler(app.Store, app.DB))
+	//expvar counters (requests, retries, re-auth replays, token renewals); also exposes cmdline and memstats
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	//API endpoint to report token expiry and background refresh status
+	router.GET("/api/tokens/status", TokenStatusHandler(tokenRefresher))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,22 @@
+package main
+
+import "expvar"
+
+// metrics are published through expvar and served to admins at /api/admin/debug/vars
+var metrics = struct {
+	Requests           *expvar.Int
+	Retries            *expvar.Int
+	AuthReplays        *expvar.Int
+	AuthReplayFailures *expvar.Int
+	TokenRefreshes     *expvar.Int
+	TokenLogins        *expvar.Int
+	TokenRenewFailures *expvar.Int
+}{
+	Requests:           expvar.NewInt("felicity_requests_total"),
+	Retries:            expvar.NewInt("felicity_retries_total"),
+	AuthReplays:        expvar.NewInt("felicity_auth_replays_total"),
+	AuthReplayFailures: expvar.NewInt("felicity_auth_replay_failures_total"),
+	TokenRefreshes:     expvar.NewInt("felicity_token_refreshes_total"),
+	TokenLogins:        expvar.NewInt("felicity_token_logins_total"),
+	TokenRenewFailures: expvar.NewInt("felicity_token_renew_failures_total"),
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the versioned schema changes for each dialect, named
+// migrations/<dialect>/NNNN_description.up.sql with a matching .down.sql that undoes it
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql migrations/timescale/*.sql
+var migrationFiles embed.FS
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// loadMigrations reads the embedded migrations for dialect in version order
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := "migrations/" + dialect + "/"
+	files, err := fs.Glob(migrationFiles, dir+"*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("error listing migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := strings.TrimPrefix(file, dir)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", base)
+		}
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must be named NNNN_description.%s.sql", base, direction)
+		}
+
+		contents, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s: %w", base, err)
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func createMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+					version INTEGER PRIMARY KEY,
+					name TEXT NOT NULL,
+					applied_at TIMESTAMP NOT NULL
+					)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations returns when each applied version was applied
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schema_migrations: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating schema_migrations: %w", err)
+	}
+	return applied, nil
+}
+
+// MigrateUp applies every pending migration for dialect in order, each in its own
+// transaction, and returns how many were applied
+func MigrateUp(db *sql.DB, dialect string) (int, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return 0, err
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	adopted := false
+	if len(applied) == 0 && dialect == dialectSQLite {
+		if adopted, err = adoptLegacySchema(db); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := runMigration(db, m.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(rebind(dialect, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.Version, m.Name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("error applying migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		fmt.Printf("Applied %s migration %04d_%s\n", dialect, m.Version, m.Name)
+		count++
+	}
+
+	//epoch columns added by a migration or missing from adopted rows need Go's time parsing
+	if dialect == dialectSQLite && (adopted || count > 0) {
+		if err := fillEventTimestamps(db); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// MigrateDown reverts the newest steps applied migrations and returns how many were reverted
+func MigrateDown(db *sql.DB, dialect string, steps int) (int, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return 0, err
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := runMigration(db, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(rebind(dialect, "DELETE FROM schema_migrations WHERE version = ?"), m.Version)
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("error reverting migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		fmt.Printf("Reverted %s migration %04d_%s\n", dialect, m.Version, m.Name)
+		count++
+	}
+	return count, nil
+}
+
+// runMigration executes a migration script and its bookkeeping atomically
+func runMigration(db *sql.DB, script string, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("error recording migration: %w", err)
+	}
+	return tx.Commit()
+}
+
+// GetMigrationStatus lists every known migration for dialect and whether it has been applied
+func GetMigrationStatus(db *sql.DB, dialect string) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := createMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if appliedAt, ok := applied[m.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// adoptLegacySchema brings a database created before migrations existed, when tables were
+// made ad hoc at startup, up to the shape 0001_initial_schema expects. Its CREATE ... IF NOT
+// EXISTS statements then fill in whatever is still missing. It reports whether there was
+// a legacy schema to adopt.
+func adoptLegacySchema(db *sql.DB) (bool, error) {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'device_data'").Scan(&tables); err != nil {
+		return false, fmt.Errorf("error checking for a legacy schema: %w", err)
+	}
+	if tables == 0 {
+		return false, nil //fresh database
+	}
+	fmt.Println("Adopting existing database into schema migrations")
+
+	for _, column := range legacyDeviceDataColumns {
+		if err := addColumnIfMissing(db, "device_data", column.name, column.decl); err != nil {
+			return false, err
+		}
+	}
+	if err := createDeviceDataUniqueIndex(db); err != nil {
+		return false, err
+	}
+	if err := fillDataTimestamps(db); err != nil {
+		return false, err
+	}
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'events'").Scan(&tables); err != nil {
+		return false, fmt.Errorf("error checking for a legacy events table: %w", err)
+	}
+	if tables > 0 {
+		if err := addColumnIfMissing(db, "events", "start_ts", "INTEGER"); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// legacyDeviceDataColumns were added to device_data after it was first released
+var legacyDeviceDataColumns = []struct{ name, decl string }{
+	{"pv1_voltage_v", "REAL"},
+	{"pv1_current_a", "REAL"},
+	{"pv2_voltage_v", "REAL"},
+	{"pv2_current_a", "REAL"},
+	{"grid_voltage_v", "REAL"},
+	{"grid_current_a", "REAL"},
+	{"grid_frequency_hz", "REAL"},
+	{"ac_output_frequency_hz", "REAL"},
+	{"battery_current_a", "REAL"},
+	{"inverter_temp_c", "REAL"},
+	{"dc_temp_c", "REAL"},
+	{"fault_code", "TEXT"},
+	{"warning_code", "TEXT"},
+	{"raw_json", "TEXT"},
+	{"data_ts", "INTEGER"},
+}
+
+// fillDataTimestamps sets data_ts on rows stored before it existed. It needs Go's time
+// parsing, which is why it can't be a SQL migration.
+func fillDataTimestamps(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, data_time FROM device_data WHERE data_ts IS NULL AND data_time IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("error reading rows without data_ts: %w", err)
+	}
+	timestamps := make(map[int64]int64)
+	for rows.Next() {
+		var id int64
+		var dataTime string
+		if err := rows.Scan(&id, &dataTime); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning rows without data_ts: %w", err)
+		}
+		if t, err := parseDeviceTime(dataTime); err == nil {
+			timestamps[id] = t.Unix()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("error iterating rows without data_ts: %w", err)
+	}
+	rows.Close()
+	if len(timestamps) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for id, ts := range timestamps {
+		if _, err := tx.Exec("UPDATE device_data SET data_ts = ? WHERE id = ?", ts, id); err != nil {
+			return fmt.Errorf("error setting data_ts: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	fmt.Printf("Filled in data_ts for %d stored rows\n", len(timestamps))
+	return nil
+}
+
+// fillEventTimestamps sets the epoch columns of events stored before they existed, so those
+// events still match from/to filters and are ordered on the timeline
+func fillEventTimestamps(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, start_time, last_seen, end_time FROM events
+		WHERE start_ts IS NULL OR (last_seen_ts IS NULL AND last_seen IS NOT NULL) OR (end_ts IS NULL AND end_time IS NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("error reading events without timestamps: %w", err)
+	}
+	type eventTimes struct{ start, lastSeen, end interface{} }
+	timestamps := make(map[int64]eventTimes)
+	for rows.Next() {
+		var id int64
+		var startTime string
+		var lastSeen, endTime sql.NullString
+		if err := rows.Scan(&id, &startTime, &lastSeen, &endTime); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning events without timestamps: %w", err)
+		}
+		timestamps[id] = eventTimes{deviceTimestamp(startTime), deviceTimestamp(lastSeen.String), deviceTimestamp(endTime.String)}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("error iterating events without timestamps: %w", err)
+	}
+	rows.Close()
+	if len(timestamps) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for id, ts := range timestamps {
+		if _, err := tx.Exec("UPDATE events SET start_ts = ?, last_seen_ts = ?, end_ts = ? WHERE id = ?", ts.start, ts.lastSeen, ts.end, id); err != nil {
+			return fmt.Errorf("error setting event timestamps: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	fmt.Printf("Filled in timestamps for %d stored events\n", len(timestamps))
+	return nil
+}
+
+// addColumnIfMissing adds column to table unless it is already there
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("error scanning columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl)); err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// createDeviceDataUniqueIndex makes (device_sn, data_time) unique so repeated fetches upsert
+// instead of duplicating. Older databases may hold duplicates, which are collapsed to the newest row first.
+func createDeviceDataUniqueIndex(db *sql.DB) error {
+	var exists int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_device_data_sn_time'").Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("error checking device_data index: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for device_data index: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM device_data WHERE id NOT IN (SELECT MAX(id) FROM device_data GROUP BY device_sn, data_time)")
+	if err != nil {
+		return fmt.Errorf("error removing duplicate device data rows: %w", err)
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX idx_device_data_sn_time ON device_data (device_sn, data_time)")
+	if err != nil {
+		return fmt.Errorf("error creating device_data unique index: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing device_data index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+-- PostgreSQL holds only history and calibration; operational tables stay in SQLite.
+
+CREATE TABLE IF NOT EXISTS device_data (
+    id BIGSERIAL PRIMARY KEY,
+    device_sn TEXT,
+    data_time TEXT,
+    pv_input_power_w DOUBLE PRECISION,
+    battery_power_w DOUBLE PRECISION,
+    battery_voltage_v DOUBLE PRECISION,
+    ac_output_voltage DOUBLE PRECISION,
+    ac_output_current DOUBLE PRECISION,
+    load_power_w DOUBLE PRECISION,
+    battery_percentage INTEGER,
+    log_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    pv1_voltage_v DOUBLE PRECISION,
+    pv1_current_a DOUBLE PRECISION,
+    pv2_voltage_v DOUBLE PRECISION,
+    pv2_current_a DOUBLE PRECISION,
+    grid_voltage_v DOUBLE PRECISION,
+    grid_current_a DOUBLE PRECISION,
+    grid_frequency_hz DOUBLE PRECISION,
+    ac_output_frequency_hz DOUBLE PRECISION,
+    battery_current_a DOUBLE PRECISION,
+    inverter_temp_c DOUBLE PRECISION,
+    dc_temp_c DOUBLE PRECISION,
+    fault_code TEXT,
+    warning_code TEXT,
+    raw_json TEXT,
+    data_ts BIGINT -- data_time as UTC epoch seconds
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_data_sn_time ON device_data (device_sn, data_time);
+CREATE INDEX IF NOT EXISTS idx_device_data_sn_ts ON device_data (device_sn, data_ts);
+
+CREATE TABLE IF NOT EXISTS battery_calibration (
+    id SERIAL PRIMARY KEY,
+    voltage DOUBLE PRECISION NOT NULL,
+    percentage INTEGER NOT NULL,
+    timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
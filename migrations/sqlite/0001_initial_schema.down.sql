@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS auth_tokens;
+DROP TABLE IF EXISTS backfill_progress;
+DROP TABLE IF EXISTS backfill_jobs;
+DROP TABLE IF EXISTS raw_responses;
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS devices;
+DROP TABLE IF EXISTS battery_calibration;
+DROP TABLE IF EXISTS device_data;
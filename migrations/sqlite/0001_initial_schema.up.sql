@@ -0,0 +1,109 @@
+-- The schema as it stood when migrations were introduced. Databases created before then
+-- are brought up to it by adoptLegacySchema, so every statement here must be idempotent.
+
+CREATE TABLE IF NOT EXISTS device_data (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_sn TEXT,
+    data_time TEXT,
+    pv_input_power_w REAL,
+    battery_power_w REAL,
+    battery_voltage_v REAL,
+    ac_output_voltage REAL,
+    ac_output_current REAL,
+    load_power_w REAL,
+    battery_percentage INTEGER,
+    log_time DATETIME DEFAULT CURRENT_TIMESTAMP,
+    pv1_voltage_v REAL,
+    pv1_current_a REAL,
+    pv2_voltage_v REAL,
+    pv2_current_a REAL,
+    grid_voltage_v REAL,
+    grid_current_a REAL,
+    grid_frequency_hz REAL,
+    ac_output_frequency_hz REAL,
+    battery_current_a REAL,
+    inverter_temp_c REAL,
+    dc_temp_c REAL,
+    fault_code TEXT,
+    warning_code TEXT,
+    raw_json TEXT,
+    data_ts INTEGER -- data_time as UTC epoch seconds
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_data_sn_time ON device_data (device_sn, data_time);
+CREATE INDEX IF NOT EXISTS idx_device_data_sn_ts ON device_data (device_sn, data_ts);
+
+CREATE TABLE IF NOT EXISTS battery_calibration (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    voltage REAL NOT NULL,
+    percentage INTEGER NOT NULL,
+    timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    device_sn TEXT PRIMARY KEY,
+    model TEXT,
+    firmware_version TEXT,
+    rated_power_w REAL,
+    battery_type TEXT,
+    plant_id TEXT,
+    plant_name TEXT,
+    raw_json TEXT,
+    discovered_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_sn TEXT NOT NULL,
+    code TEXT NOT NULL,
+    description TEXT,
+    severity TEXT NOT NULL,
+    source TEXT NOT NULL,
+    start_time TEXT NOT NULL,
+    end_time TEXT,
+    last_seen TEXT,
+    raw_json TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    start_ts INTEGER, -- start_time as UTC epoch seconds
+    UNIQUE (device_sn, source, code, start_time)
+);
+CREATE INDEX IF NOT EXISTS idx_events_device_time ON events (device_sn, start_time);
+
+CREATE TABLE IF NOT EXISTS raw_responses (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    endpoint TEXT NOT NULL,
+    device_sn TEXT,
+    params TEXT,
+    fetched_at DATETIME NOT NULL,
+    body_gzip BLOB NOT NULL,
+    body_size INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_raw_responses_endpoint ON raw_responses (endpoint, fetched_at);
+
+CREATE TABLE IF NOT EXISTS backfill_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_sn TEXT NOT NULL,
+    start_day TEXT NOT NULL,
+    end_day TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'running',
+    error TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    finished_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS backfill_progress (
+    device_sn TEXT NOT NULL,
+    day TEXT NOT NULL,
+    rows INTEGER NOT NULL,
+    completed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_sn, day)
+);
+
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    access_token TEXT NOT NULL,
+    refresh_token TEXT NOT NULL,
+    access_token_expiry DATETIME,
+    refresh_token_expiry DATETIME,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
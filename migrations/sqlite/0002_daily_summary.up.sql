@@ -0,0 +1,21 @@
+-- One row per device and plant-local day, recomputed from device_data whenever that day's
+-- samples are written. Energy is integrated from the power columns (see IntegrateEnergy).
+
+CREATE TABLE IF NOT EXISTS daily_summary (
+    device_sn TEXT NOT NULL,
+    day TEXT NOT NULL, -- YYYY-MM-DD in the plant's time zone
+    pv_kwh REAL NOT NULL,
+    load_kwh REAL NOT NULL,
+    battery_charge_kwh REAL NOT NULL,
+    battery_discharge_kwh REAL NOT NULL,
+    battery_voltage_min REAL,
+    battery_voltage_max REAL,
+    battery_percentage_min INTEGER,
+    battery_percentage_max INTEGER,
+    peak_load_w REAL,
+    peak_pv_w REAL,
+    coverage_hours REAL NOT NULL,
+    samples INTEGER NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_sn, day)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_raw_responses_body;
+ALTER TABLE raw_responses DROP COLUMN body_sha256;
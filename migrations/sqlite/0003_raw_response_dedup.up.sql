@@ -0,0 +1,5 @@
+-- body_sha256 lets Save skip a body already archived for the same request (endpoint, device
+-- and query parameters, which include the day and page); every other fetch is still kept.
+
+ALTER TABLE raw_responses ADD COLUMN body_sha256 TEXT;
+CREATE INDEX IF NOT EXISTS idx_raw_responses_body ON raw_responses (endpoint, device_sn, params, body_sha256);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_events_device_ts;
+ALTER TABLE events DROP COLUMN end_ts;
+ALTER TABLE events DROP COLUMN last_seen_ts;
@@ -0,0 +1,6 @@
+-- Epoch copies of last_seen and end_time, so events are compared on the timeline rather than
+-- as device time strings. Rows already stored are filled in by fillEventTimestamps.
+
+ALTER TABLE events ADD COLUMN last_seen_ts INTEGER;
+ALTER TABLE events ADD COLUMN end_ts INTEGER;
+CREATE INDEX IF NOT EXISTS idx_events_device_ts ON events (device_sn, start_ts);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS battery_calibration;
+DROP TABLE IF EXISTS device_data;
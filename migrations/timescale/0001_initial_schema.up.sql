@@ -0,0 +1,45 @@
+-- TimescaleDB holds only history and calibration; operational tables stay in SQLite.
+-- device_data is a hypertable on device_time, so the unique key that upserts rely on
+-- has to include it and there is no primary key on id.
+
+CREATE EXTENSION IF NOT EXISTS timescaledb;
+
+CREATE TABLE IF NOT EXISTS device_data (
+    id BIGSERIAL NOT NULL,
+    device_sn TEXT NOT NULL,
+    data_time TEXT,
+    device_time TIMESTAMPTZ NOT NULL, -- data_time parsed in the plant's time zone
+    pv_input_power_w DOUBLE PRECISION,
+    battery_power_w DOUBLE PRECISION,
+    battery_voltage_v DOUBLE PRECISION,
+    ac_output_voltage DOUBLE PRECISION,
+    ac_output_current DOUBLE PRECISION,
+    load_power_w DOUBLE PRECISION,
+    battery_percentage INTEGER,
+    log_time TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    pv1_voltage_v DOUBLE PRECISION,
+    pv1_current_a DOUBLE PRECISION,
+    pv2_voltage_v DOUBLE PRECISION,
+    pv2_current_a DOUBLE PRECISION,
+    grid_voltage_v DOUBLE PRECISION,
+    grid_current_a DOUBLE PRECISION,
+    grid_frequency_hz DOUBLE PRECISION,
+    ac_output_frequency_hz DOUBLE PRECISION,
+    battery_current_a DOUBLE PRECISION,
+    inverter_temp_c DOUBLE PRECISION,
+    dc_temp_c DOUBLE PRECISION,
+    fault_code TEXT,
+    warning_code TEXT,
+    raw_json TEXT,
+    data_ts BIGINT -- device_time as UTC epoch seconds, kept for parity with the other stores
+);
+SELECT create_hypertable('device_data', 'device_time', chunk_time_interval => INTERVAL '7 days', if_not_exists => TRUE);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_device_data_sn_time ON device_data (device_sn, device_time);
+CREATE INDEX IF NOT EXISTS idx_device_data_id ON device_data (id);
+
+CREATE TABLE IF NOT EXISTS battery_calibration (
+    id SERIAL PRIMARY KEY,
+    voltage DOUBLE PRECISION NOT NULL,
+    percentage INTEGER NOT NULL,
+    timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP MATERIALIZED VIEW IF EXISTS device_data_daily;
+DROP MATERIALIZED VIEW IF EXISTS device_data_hourly;
@@ -0,0 +1,58 @@
+-- Hourly and daily rollups of device_data, kept current by refresh policies. Buckets are
+-- UTC; a daily bucket matches the plant's calendar day only when the plant is on UTC.
+-- Created WITH NO DATA because materializing inside the migration's transaction isn't allowed;
+-- the policies fill them in on their first run.
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS device_data_hourly
+WITH (timescaledb.continuous) AS
+SELECT
+    device_sn,
+    time_bucket(INTERVAL '1 hour', device_time) AS bucket,
+    count(*) AS samples,
+    avg(pv_input_power_w) AS pv_input_power_w_avg,
+    max(pv_input_power_w) AS pv_input_power_w_max,
+    avg(battery_power_w) AS battery_power_w_avg,
+    avg(battery_voltage_v) AS battery_voltage_v_avg,
+    min(battery_voltage_v) AS battery_voltage_v_min,
+    max(battery_voltage_v) AS battery_voltage_v_max,
+    avg(load_power_w) AS load_power_w_avg,
+    max(load_power_w) AS load_power_w_max,
+    avg(battery_percentage) AS battery_percentage_avg,
+    min(battery_percentage) AS battery_percentage_min,
+    max(battery_percentage) AS battery_percentage_max
+FROM device_data
+GROUP BY device_sn, bucket
+WITH NO DATA;
+
+SELECT add_continuous_aggregate_policy('device_data_hourly',
+    start_offset => INTERVAL '3 days',
+    end_offset => INTERVAL '1 hour',
+    schedule_interval => INTERVAL '30 minutes',
+    if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS device_data_daily
+WITH (timescaledb.continuous) AS
+SELECT
+    device_sn,
+    time_bucket(INTERVAL '1 day', device_time) AS bucket,
+    count(*) AS samples,
+    avg(pv_input_power_w) AS pv_input_power_w_avg,
+    max(pv_input_power_w) AS pv_input_power_w_max,
+    avg(battery_power_w) AS battery_power_w_avg,
+    avg(battery_voltage_v) AS battery_voltage_v_avg,
+    min(battery_voltage_v) AS battery_voltage_v_min,
+    max(battery_voltage_v) AS battery_voltage_v_max,
+    avg(load_power_w) AS load_power_w_avg,
+    max(load_power_w) AS load_power_w_max,
+    avg(battery_percentage) AS battery_percentage_avg,
+    min(battery_percentage) AS battery_percentage_min,
+    max(battery_percentage) AS battery_percentage_max
+FROM device_data
+GROUP BY device_sn, bucket
+WITH NO DATA;
+
+SELECT add_continuous_aggregate_policy('device_data_daily',
+    start_offset => INTERVAL '7 days',
+    end_offset => INTERVAL '1 day',
+    schedule_interval => INTERVAL '6 hours',
+    if_not_exists => TRUE);
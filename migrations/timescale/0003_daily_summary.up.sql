@@ -0,0 +1,21 @@
+-- One row per device and plant-local day, recomputed from device_data whenever that day's
+-- samples are written. Energy is integrated from the power columns (see IntegrateEnergy).
+
+CREATE TABLE IF NOT EXISTS daily_summary (
+    device_sn TEXT NOT NULL,
+    day TEXT NOT NULL, -- YYYY-MM-DD in the plant's time zone
+    pv_kwh DOUBLE PRECISION NOT NULL,
+    load_kwh DOUBLE PRECISION NOT NULL,
+    battery_charge_kwh DOUBLE PRECISION NOT NULL,
+    battery_discharge_kwh DOUBLE PRECISION NOT NULL,
+    battery_voltage_min DOUBLE PRECISION,
+    battery_voltage_max DOUBLE PRECISION,
+    battery_percentage_min INTEGER,
+    battery_percentage_max INTEGER,
+    peak_load_w DOUBLE PRECISION,
+    peak_pv_w DOUBLE PRECISION,
+    coverage_hours DOUBLE PRECISION NOT NULL,
+    samples INTEGER NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_sn, day)
+);
@@ -0,0 +1,2 @@
+ALTER MATERIALIZED VIEW device_data_daily SET (timescaledb.materialized_only = true);
+ALTER MATERIALIZED VIEW device_data_hourly SET (timescaledb.materialized_only = true);
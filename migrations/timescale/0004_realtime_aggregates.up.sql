@@ -0,0 +1,7 @@
+-- Serve the rollups in real time: buckets the refresh policies haven't materialized yet are
+-- aggregated from device_data at query time, so /api/history/aggregate can read the views
+-- right up to now. Older history written after its buckets were materialized (a backfill or
+-- a reprocess) still needs refresh_continuous_aggregate, which RefreshRollups calls.
+
+ALTER MATERIALIZED VIEW device_data_hourly SET (timescaledb.materialized_only = false);
+ALTER MATERIALIZED VIEW device_data_daily SET (timescaledb.materialized_only = false);
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrPollInProgress is returned when a poll is requested while another one is still running
+var ErrPollInProgress = errors.New("a device data fetch is already in progress")
+
+// Poller ingests history for every configured device on a fixed interval so data lands without a
+// button press. The first poll of a new day also fetches every day since the last successful poll,
+// up to maxCatchUpDays, so their last samples aren't lost. A failing device doesn't stop the others
+// from being polled.
+type Poller struct {
+	app      *App
+	interval time.Duration
+
+	mu       sync.Mutex
+	polling  bool
+	paused   bool
+	lastDate string // day of the last successful poll, for the midnight catch-up
+	status   PollerStatus
+}
+
+// PollerStatus is reported by GET /api/poller/status
+type PollerStatus struct {
+	Interval   string     `json:"interval"`
+	Paused     bool       `json:"paused"`
+	Polling    bool       `json:"polling"`
+	Polls      int        `json:"polls"`
+	Overlaps   int        `json:"overlapsSkipped"`
+	LastStart  *time.Time `json:"lastStart,omitempty"`
+	LastFinish *time.Time `json:"lastFinish,omitempty"`
+	LastRows   int        `json:"lastRows"`
+	LastError  string     `json:"lastError,omitempty"`
+	NextRun    *time.Time `json:"nextRun,omitempty"`
+
+	Devices map[string]*DevicePollStatus `json:"devices"`
+}
+
+// DevicePollStatus is the per-device outcome of the most recent poll
+type DevicePollStatus struct {
+	LastRows    int        `json:"lastRows"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func NewPoller(app *App, interval time.Duration) *Poller {
+	devices := make(map[string]*DevicePollStatus)
+	for _, sn := range app.Devices {
+		devices[sn] = &DevicePollStatus{}
+	}
+	return &Poller{app: app, interval: interval, status: PollerStatus{Devices: devices}}
+}
+
+// Run polls immediately and then every interval until ctx is cancelled
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.mu.Lock()
+		paused := p.paused
+		p.mu.Unlock()
+
+		if !paused {
+			_, err := p.PollOnce(ctx)
+			if errors.Is(err, ErrPollInProgress) {
+				fmt.Println("Scheduled poll skipped: previous fetch still running.")
+			}
+		}
+
+		next := time.Now().Add(p.interval)
+		p.mu.Lock()
+		p.status.NextRun = &next
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollOnce fetches today's history (and any days missed since the last poll) unless a poll is already running
+func (p *Poller) PollOnce(ctx context.Context) (int, error) {
+	p.mu.Lock()
+	if p.polling {
+		p.status.Overlaps++
+		p.mu.Unlock()
+		return 0, ErrPollInProgress
+	}
+	p.polling = true
+	started := time.Now()
+	p.status.LastStart = &started
+	lastDate := p.lastDate
+	p.mu.Unlock()
+
+	rows, err := p.poll(ctx, started.In(plantLocation), lastDate)
+
+	finished := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.polling = false
+	p.status.Polls++
+	p.status.LastFinish = &finished
+	p.status.LastRows = rows
+	p.status.LastError = ""
+	if err != nil {
+		p.status.LastError = err.Error()
+		fmt.Println("Poll failed:", err)
+	} else {
+		p.lastDate = started.In(plantLocation).Format(backfillDateLayout)
+	}
+	return rows, err
+}
+
+// maxCatchUpDays caps how many missed days a poll fetches after the poller was stopped or
+// failing; anything older is left to a backfill
+const maxCatchUpDays = 7
+
+func (p *Poller) poll(ctx context.Context, now time.Time, lastDate string) (int, error) {
+	dates := p.pollDates(now, lastDate)
+
+	total := 0
+	var errs []error
+	for _, deviceSn := range p.app.Devices {
+		rows, err := p.pollDevice(ctx, deviceSn, dates)
+		total += rows
+
+		finished := time.Now()
+		p.mu.Lock()
+		deviceStatus := p.status.Devices[deviceSn]
+		deviceStatus.LastRows = rows
+		deviceStatus.LastError = ""
+		if err != nil {
+			deviceStatus.LastError = err.Error()
+			errs = append(errs, err)
+		} else {
+			deviceStatus.LastSuccess = &finished
+		}
+		p.mu.Unlock()
+	}
+	return total, errors.Join(errs...)
+}
+
+// pollDates returns the days to fetch, oldest first: lastDate, whose samples after the last
+// poll are still missing, and every day after it up to and including today, at most
+// maxCatchUpDays of them before today. Without a previous poll the previous day is only
+// included shortly after midnight.
+func (p *Poller) pollDates(now time.Time, lastDate string) []string {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	first := today
+	if last, err := time.ParseInLocation(backfillDateLayout, lastDate, now.Location()); err == nil {
+		first = last
+	} else if now.Sub(today) < p.interval {
+		first = today.AddDate(0, 0, -1)
+	}
+	if oldest := today.AddDate(0, 0, -maxCatchUpDays); first.Before(oldest) {
+		fmt.Printf("Poller last succeeded on %s; catching up the last %d days only, backfill the rest.\n", lastDate, maxCatchUpDays)
+		first = oldest
+	}
+
+	dates := []string{}
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(backfillDateLayout))
+	}
+	return dates
+}
+
+func (p *Poller) pollDevice(ctx context.Context, deviceSn string, dates []string) (int, error) {
+	total := 0
+	for _, dateStr := range dates {
+		rows, err := ingestDeviceDataHistory(ctx, p.app, deviceSn, dateStr)
+		total += rows
+		if err != nil {
+			return total, fmt.Errorf("error polling %s for %s: %w", deviceSn, dateStr, err)
+		}
+		//alarms are best effort; the history above is what the poll is judged on
+		if alarms, err := IngestDeviceAlarms(ctx, p.app.DB, p.app.Client, deviceSn, dateStr); err != nil {
+			fmt.Printf("Error fetching alarms for %s on %s: %v\n", deviceSn, dateStr, err)
+		} else if alarms > 0 {
+			fmt.Printf("Stored %d alarms for %s on %s\n", alarms, deviceSn, dateStr)
+		}
+	}
+	return total, nil
+}
+
+func (p *Poller) SetPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+func (p *Poller) Status() PollerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	status.Interval = p.interval.String()
+	status.Paused = p.paused
+	status.Polling = p.polling
+	status.Devices = make(map[string]*DevicePollStatus, len(p.status.Devices))
+	for sn, deviceStatus := range p.status.Devices {
+		copied := *deviceStatus
+		status.Devices[sn] = &copied
+	}
+	if p.paused {
+		status.NextRun = nil
+	}
+	return status
+}
+
+func PollerStatusHandler(p *Poller) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, p.Status())
+	}
+}
+
+// PollerPauseHandler pauses (paused=true) or resumes scheduled polling
+func PollerPauseHandler(p *Poller, paused bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p.SetPaused(paused)
+		c.JSON(http.StatusOK, p.Status())
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPollDates(t *testing.T) {
+	p := &Poller{interval: 15 * time.Minute}
+	noon := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		now      time.Time
+		lastDate string
+		want     []string
+	}{
+		{"same day", noon, "2024-03-10", []string{"2024-03-10"}},
+		{"first poll of a new day", noon, "2024-03-09", []string{"2024-03-09", "2024-03-10"}},
+		{"stopped for a few days", noon, "2024-03-07", []string{"2024-03-07", "2024-03-08", "2024-03-09", "2024-03-10"}},
+		{"stopped for longer than the cap", noon, "2024-02-01",
+			[]string{"2024-03-03", "2024-03-04", "2024-03-05", "2024-03-06", "2024-03-07", "2024-03-08", "2024-03-09", "2024-03-10"}},
+		{"first poll midday", noon, "", []string{"2024-03-10"}},
+		{"first poll just after midnight", time.Date(2024, 3, 10, 0, 5, 0, 0, time.UTC), "", []string{"2024-03-09", "2024-03-10"}},
+		{"across a month boundary", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC), "2024-02-28", []string{"2024-02-28", "2024-02-29", "2024-03-01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.pollDates(tt.now, tt.lastDate); !slices.Equal(got, tt.want) {
+				t.Errorf("pollDates(%v, %q) = %v, want %v", tt.now, tt.lastDate, got, tt.want)
+			}
+		})
+	}
+}
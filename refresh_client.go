@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"strconv"
 	"time"
 )
 
-//const baseURL = "https://shine-api.felicitysolar.com" // Base URL from documentation
-
 // type RefreshTokenRequest struct {
 // 	RefreshToken string `json:"refreshToken"`
 // }
@@ -27,110 +24,85 @@ import (
 // 	} `json:"data"`
 // }
 
-func RefreshAccessToken() (newAccessToken, newRefreshToken string, newAccessTokenExpiry, newRefreshTokenExpiry time.Time, err error) {
-	apiURL, err := url.Parse(baseURL + "/openApi/sec/refreshToken")
-	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error parsing refresh token URL: %w", err)
+// RefreshAccessToken trades a refresh token for new tokens, retrying transient envelope failures
+func (c *FelicityClient) RefreshAccessToken(ctx context.Context, refreshToken string) (*StoredTokens, error) {
+	if refreshToken == "" {
+		return nil, fmt.Errorf("no refresh token available")
 	}
+	var tokens *StoredTokens
+	err := c.withEnvelopeRetry(ctx, "refresh token", func() error {
+		var err error
+		tokens, err = c.refreshOnce(ctx, refreshToken)
+		return err
+	})
+	return tokens, err
+}
 
-	storedTokens, err := loadTokensFromFile()
-	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error loading tokens for refresh: %w", err)
-	}
-	if storedTokens == nil || storedTokens.RefreshToken == "" {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("no refresh token available")
-	}
-
-	refreshToken := storedTokens.RefreshToken
-
+func (c *FelicityClient) refreshOnce(ctx context.Context, refreshToken string) (*StoredTokens, error) {
 	requestBody := map[string]string{
 		"refreshToken": refreshToken,
 	}
-	requestBodyBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error marshaling refresh request body: %w", err)
-	}
 
-	req, err := http.NewRequest("POST", apiURL.String(), bytes.NewBuffer(requestBodyBytes))
+	req, err := c.newRequest(ctx, "POST", "/openApi/sec/refreshToken", nil, requestBody)
 	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error creating refresh token request: %w", err)
+		return nil, fmt.Errorf("error creating refresh token request: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error sending refresh token request: %w", err)
+		return nil, fmt.Errorf("error sending refresh token request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("refresh token request failed with status code: %d", resp.StatusCode)
+		return nil, apiErrorFromResponse("refresh token", resp)
 	}
 
 	var refreshResponse LoginResponse
 	decoder := json.NewDecoder(resp.Body)
 	if err := decoder.Decode(&refreshResponse); err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error decoding refresh response body: %w", err)
+		return nil, fmt.Errorf("error decoding refresh response body: %w", err)
 	}
 
-	if refreshResponse.Code == 998 {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("refresh token expired, please log in again")
+	if refreshResponse.Code != apiCodeOK {
+		//code 998 means the refresh token expired and a new login is needed; APIError.Is reports it as ErrTokenExpired
+		return nil, &APIError{Op: "refresh token", StatusCode: resp.StatusCode, Code: refreshResponse.Code, Message: refreshResponse.Message}
 	}
 
-	if refreshResponse.Code != 200 {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("refresh token API error: code=%d, message=%s", refreshResponse.Code, refreshResponse.Message)
-	}
+	return tokensFromResponse(&refreshResponse)
+}
 
+// tokensFromResponse converts a login/refresh response into StoredTokens
+func tokensFromResponse(response *LoginResponse) (*StoredTokens, error) {
 	// Convert timestamps (milliseconds as strings) to time.Time
-	accessTokenExpiryTimestamp, err := strconv.ParseInt(refreshResponse.Data.TokenExpireTime, 10, 64)
+	accessTokenExpiryTimestamp, err := strconv.ParseInt(response.Data.TokenExpireTime, 10, 64)
 	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error parsing access token expiry time: %w", err)
+		return nil, fmt.Errorf("error parsing access token expiry time: %w", err)
 	}
-	newAccessTokenExpiry = time.Unix(accessTokenExpiryTimestamp/1000, 0) // Convert milliseconds to seconds
+	accessTokenExpiry := time.Unix(accessTokenExpiryTimestamp/1000, 0) // Convert milliseconds to seconds
 
-	refreshTokenExpiryTimestamp, err := strconv.ParseInt(refreshResponse.Data.RefTokenExpireTime, 10, 64)
+	refreshTokenExpiryTimestamp, err := strconv.ParseInt(response.Data.RefTokenExpireTime, 10, 64)
 	if err != nil {
-		return "", "", time.Time{}, time.Time{}, fmt.Errorf("error parsing refresh token expiry time: %w", err)
+		return nil, fmt.Errorf("error parsing refresh token expiry time: %w", err)
 	}
-	newRefreshTokenExpiry = time.Unix(refreshTokenExpiryTimestamp/1000, 0) // Convert milliseconds to seconds
+	refreshTokenExpiry := time.Unix(refreshTokenExpiryTimestamp/1000, 0) // Convert milliseconds to seconds
 
-	return refreshResponse.Data.AccessToken, refreshResponse.Data.RefreshToken, newAccessTokenExpiry, newRefreshTokenExpiry, nil
+	return &StoredTokens{
+		AccessToken:        response.Data.AccessToken,
+		RefreshToken:       response.Data.RefreshToken,
+		AccessTokenExpiry:  accessTokenExpiry,
+		RefreshTokenExpiry: refreshTokenExpiry,
+	}, nil
 }
 
-func performLogin(username, password string) error {
-	loginResponse, err := Login(username, password)
+func performLogin(ctx context.Context, client *FelicityClient, username, password string) (*StoredTokens, error) {
+	loginResponse, err := client.Login(ctx, username, password)
 	if err != nil {
 		fmt.Println("Login Error:", err)
-		return err
+		return nil, err
 	}
 
 	fmt.Println("Login Successful!")
 
-	accessTokenExpiryTimestamp, err := strconv.ParseInt(loginResponse.Data.TokenExpireTime, 10, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing access token expiry time: %w", err)
-	}
-	accessTokenExpiry := time.Unix(accessTokenExpiryTimestamp/1000, 0)
-
-	refreshTokenExpiryTimestamp, err := strconv.ParseInt(loginResponse.Data.RefTokenExpireTime, 10, 64)
-	if err != nil {
-		return fmt.Errorf("error parsing refresh token expiry time: %w", err)
-	}
-	refreshTokenExpiry := time.Unix(refreshTokenExpiryTimestamp/1000, 0)
-
-	tokensToSave := &StoredTokens{
-		AccessToken:        loginResponse.Data.AccessToken,
-		RefreshToken:       loginResponse.Data.RefreshToken,
-		AccessTokenExpiry:  accessTokenExpiry,
-		RefreshTokenExpiry: refreshTokenExpiry,
-	}
-	if saveErr := saveTokensToFile(tokensToSave); saveErr != nil {
-		fmt.Println("Error saving tokens to file:", saveErr)
-		return saveErr
-	} else {
-		fmt.Println("Tokens saved to file.")
-	}
-	return nil
+	return tokensFromResponse(loginResponse)
 }
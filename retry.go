@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how failed upstream calls are retried: exponential backoff with
+// full jitter between BaseDelay and MaxDelay, honouring Retry-After when the server sends one.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// maxRetryAfter caps how long a server-supplied Retry-After can hold a request
+const maxRetryAfter = 5 * time.Minute
+
+// retryable reports whether a response/error pair for req is worth another attempt
+func (p RetryPolicy) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// the caller gave up; retrying won't help. http.Client.Timeout errors also match
+		// context.DeadlineExceeded, so only the request's own context tells the two apart.
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry (1 = first retry)
+func (p RetryPolicy) delay(retry int, resp *http.Response) time.Duration {
+	backoff := p.BaseDelay
+	for i := 1; i < retry && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.MaxDelay)
+	if backoff > 0 {
+		backoff = rand.N(backoff + 1)
+	}
+
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return max(backoff, min(retryAfter, maxRetryAfter))
+		}
+	}
+	return backoff
+}
+
+// parseRetryAfter understands both delay-seconds and HTTP-date forms
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// doWithRetry sends req, retrying transient failures. Every attempt waits on the limiter.
+// The returned response may still be a non-200 if attempts ran out.
+func doWithRetry(client *http.Client, limiter *RateLimiter, policy RetryPolicy, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attempts := max(policy.MaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		metrics.Requests.Add(1)
+		resp, err := client.Do(req)
+		if attempt >= attempts || !policy.retryable(req, resp, err) {
+			return resp, err
+		}
+		//requests with a body we can't rewind are sent once
+		if req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+
+		wait := policy.delay(attempt, resp)
+		if err != nil {
+			fmt.Printf("Felicity request %s %s failed (attempt %d/%d): %v; retrying in %s\n", req.Method, req.URL.Path, attempt, attempts, err, wait)
+		} else {
+			fmt.Printf("Felicity request %s %s returned %d (attempt %d/%d); retrying in %s\n", req.Method, req.URL.Path, resp.StatusCode, attempt, attempts, wait)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		metrics.Retries.Add(1)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// RateLimiter is a token bucket shared by every call to the Felicity API.
+// ratePerSecond must be positive.
+type RateLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func NewRateLimiter(ratePerSecond float64, burst int) *RateLimiter {
+	burst = max(burst, 1)
+	return &RateLimiter{
+		rate:     ratePerSecond,
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.capacity, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
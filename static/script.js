@@ -1,5 +1,30 @@
+// selected device serial number, empty for all devices
+function selectedDevice() {
+    return document.getElementById('device-select').value;
+}
+
+function withDevice(url) {
+    const deviceSn = selectedDevice();
+    return deviceSn ? `${url}?device_sn=${encodeURIComponent(deviceSn)}` : url;
+}
+
+async function loadDevices() {
+    const response = await fetch('/api/devices');
+    if (!response.ok) {
+        return;
+    }
+    const devices = await response.json();
+    const select = document.getElementById('device-select');
+    devices.forEach(device => {
+        const option = document.createElement('option');
+        option.value = device.deviceSn;
+        option.textContent = device.deviceSn;
+        select.appendChild(option);
+    });
+}
+
 async function runMainFunction() {
-    const response = await fetch('/api/run_main', {
+    const response = await fetch(withDevice('/api/run_main'), {
         method: 'POST', //use post to trigger the action
     });
 
@@ -16,7 +41,7 @@ async function runMainFunction() {
 }
 
 async function fetchAllHistory() {
-    const response = await fetch('/api/history');
+    const response = await fetch(withDevice('/api/history'));
     const data = await response.json();
     displayHistory(data);
     // if (response.ok) {
@@ -29,9 +54,10 @@ function displayHistory(historyData) {
     const tableBody = document.getElementById('history-table-body');
     tableBody.innerHTML = ''; // Clear previous data
 
-    historyData.forEach(item => {
+    (historyData || []).forEach(item => {
         const row = tableBody.insertRow();
         row.insertCell().textContent = item.ID;
+        row.insertCell().textContent = item.DeviceSn;
         row.insertCell().textContent = item.TimeStamp;
         row.insertCell().textContent = item.PvTotalPower;
         row.insertCell().textContent = item.EmsPower;
@@ -41,5 +67,8 @@ function displayHistory(historyData) {
     });
 }
 
-// Load all history on page load (optional)
-document.addEventListener('DOMContentLoaded', fetchAllHistory);
\ No newline at end of file
+// Load devices and all history on page load (optional)
+document.addEventListener('DOMContentLoaded', async () => {
+    await loadDevices();
+    fetchAllHistory();
+});
\ No newline at end of file
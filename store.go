@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// HistoryStore persists device telemetry
+type HistoryStore interface {
+	// SaveHistory upserts records on (device_sn, data_time), filling in the derived fields
+	SaveHistory(dataList []DeviceData) error
+	// AllHistory returns every sample in timeRange, for one device when deviceSn is set
+	AllHistory(deviceSn string, timeRange TimeRange) ([]DbData, error)
+	// HistoryPage returns one page of samples with cursors to its neighbours
+	HistoryPage(q HistoryQuery) (HistoryPage, error)
+	// HistorySamples returns numeric columns of every sample in timeRange, ordered by device and time
+	HistorySamples(deviceSn string, timeRange TimeRange, columns []string) ([]Sample, error)
+	// HistoryBuckets returns numeric columns grouped into time buckets, ordered by device and bucket
+	HistoryBuckets(q BucketQuery) ([]Bucket, error)
+	// UpdateBatteryPercentages re-derives battery_percentage of every sample with a battery voltage,
+	// returning how many changed and the devices and plant-local days they fall on
+	UpdateBatteryPercentages(percentage func(voltage float64) int) (int, map[string][]string, error)
+	// ClearHistory deletes every sample, along with anything derived from them
+	ClearHistory() error
+	// ClearDeviceHistory deletes the samples and summaries of the given devices in one transaction
+	ClearDeviceHistory(deviceSns []string) error
+	// RefreshRollups recomputes any rollups of timeRange (unbounded ends for everything) after
+	// history in it was rewritten
+	RefreshRollups(timeRange TimeRange) error
+}
+
+// CalibrationStore persists the battery voltage to percentage calibration points
+type CalibrationStore interface {
+	AddCalibration(voltage float64, percentage int) error
+	// UpdateCalibration changes a point and returns how many rows were updated
+	UpdateCalibration(id int, voltage float64, percentage int) (int64, error)
+	Calibration(id int) (CalibrationRecord, error)
+	Calibrations() ([]CalibrationRecord, error)
+}
+
+// SummaryStore persists the per-device daily rollups in daily_summary
+type SummaryStore interface {
+	// SaveDailySummary inserts or replaces the summary for its device and day
+	SaveDailySummary(summary DailySummary) error
+	DeleteDailySummary(deviceSn, day string) error
+	// DailySummaries returns summaries for days from to to (inclusive), for one device when deviceSn is set
+	DailySummaries(deviceSn, from, to string) ([]DailySummary, error)
+}
+
+// Store is a database holding history, calibration and summary data. Operational state (devices,
+// events, backfill progress, the response archive, tokens) stays in the local SQLite file.
+type Store interface {
+	HistoryStore
+	CalibrationStore
+	SummaryStore
+	Close() error
+}
+
+// NewStore picks the storage backend for HISTORY_STORE: sqlite (default) keeps everything in
+// the local database file, postgres and timescale use the shared database at DATABASE_URL.
+func NewStore(kind string, db *sql.DB) (Store, error) {
+	switch kind {
+	case "", "sqlite":
+		return NewSQLiteStore(db), nil
+	case "postgres":
+		return NewPostgresStore(os.Getenv("DATABASE_URL"))
+	case "timescale":
+		return NewTimescaleStore(os.Getenv("DATABASE_URL"))
+	default:
+		return nil, fmt.Errorf("unknown history store %q (expected sqlite, postgres or timescale)", kind)
+	}
+}
+
+// SQL dialects the stores and migrations are written for
+const (
+	dialectSQLite    = "sqlite"
+	dialectPostgres  = "postgres"
+	dialectTimescale = "timescale" // PostgreSQL with the TimescaleDB extension
+)
+
+// rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL and TimescaleDB
+func rebind(dialect, query string) string {
+	if dialect == dialectSQLite {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlStore is the history and calibration SQL shared by the SQLite and PostgreSQL stores
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (s *sqlStore) bind(query string) string {
+	return rebind(s.dialect, query)
+}
+
+// timeColumn is the device_data column holding the sample's time: data_ts, or the
+// hypertable's device_time on TimescaleDB
+func (s *sqlStore) timeColumn() string {
+	if s.dialect == dialectTimescale {
+		return "device_time"
+	}
+	return "data_ts"
+}
+
+// timeConditions restricts device_data to timeRange. On TimescaleDB the filter goes on
+// device_time, the hypertable's partitioning column, so chunks outside the range are skipped.
+func (s *sqlStore) timeConditions(timeRange TimeRange) ([]string, []interface{}) {
+	if s.dialect != dialectTimescale {
+		return timeRange.conditions("data_ts")
+	}
+	var conditions []string
+	var args []interface{}
+	if !timeRange.From.IsZero() {
+		conditions = append(conditions, "device_time >= ?")
+		args = append(args, timeRange.From)
+	}
+	if !timeRange.To.IsZero() {
+		conditions = append(conditions, "device_time < ?")
+		args = append(args, timeRange.To)
+	}
+	return conditions, args
+}
+
+// ClearDeviceHistory deletes the samples and daily summaries of deviceSns, all or none of them
+func (s *sqlStore) ClearDeviceHistory(deviceSns []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for clearing data: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, deviceSn := range deviceSns {
+		if _, err := tx.Exec(s.bind("DELETE FROM device_data WHERE device_sn = ?"), deviceSn); err != nil {
+			return fmt.Errorf("error clearing device data history of %s: %w", deviceSn, err)
+		}
+		if _, err := tx.Exec(s.bind("DELETE FROM daily_summary WHERE device_sn = ?"), deviceSn); err != nil {
+			return fmt.Errorf("error clearing daily summaries of %s: %w", deviceSn, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// SQLiteStore keeps history and calibration in the local database file
+type SQLiteStore struct {
+	sqlStore
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{sqlStore{db: db, dialect: dialectSQLite}}
+}
+
+// ClearHistory deletes every sample and its summaries, and resets the id sequence
+func (s *SQLiteStore) ClearHistory() error {
+	tx, err := s.db.Begin() //atomicity
+	if err != nil {
+		return fmt.Errorf("error starting transaction for clearing data: %v", err)
+	}
+	defer tx.Rollback() //rollback in case of errors
+
+	_, err = tx.Exec("DELETE FROM device_data")
+	if err != nil {
+		return fmt.Errorf("error clearing device data history: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM daily_summary")
+	if err != nil {
+		return fmt.Errorf("error clearing daily summaries: %w", err)
+	}
+
+	//reset auto-increment sequence
+	_, err = tx.Exec("DELETE FROM sqlite_sequence WHERE name = 'device_data'")
+	if err != nil {
+		return fmt.Errorf("error resetting sequence for device_data: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil { //commit transaction is successful
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// Close is a no-op; the database file belongs to the App
+func (s *SQLiteStore) Close() error {
+	return nil
+}
+
+// PostgresStore keeps history and calibration in a shared PostgreSQL or TimescaleDB database
+type PostgresStore struct {
+	sqlStore
+}
+
+// NewPostgresStore connects to dsn and migrates its schema
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := openPostgres(dsn, dialectPostgres)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{sqlStore{db: db, dialect: dialectPostgres}}, nil
+}
+
+// NewTimescaleStore connects to dsn, a PostgreSQL database with the TimescaleDB extension
+// available, and migrates its schema: device_data as a hypertable on device_time plus
+// the device_data_hourly and device_data_daily continuous aggregates.
+func NewTimescaleStore(dsn string) (*PostgresStore, error) {
+	db, err := openPostgres(dsn, dialectTimescale)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{sqlStore{db: db, dialect: dialectTimescale}}, nil
+}
+
+// openPostgres connects to dsn and applies the dialect's migrations
+func openPostgres(dsn, dialect string) (*sql.DB, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("DATABASE_URL must be set when HISTORY_STORE=%s", dialect)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s database: %w", dialect, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to %s database: %w", dialect, err)
+	}
+	if _, err := MigrateUp(db, dialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// ClearHistory deletes every sample and its summaries, and resets the id sequence
+func (s *PostgresStore) ClearHistory() error {
+	if _, err := s.db.Exec("TRUNCATE device_data, daily_summary RESTART IDENTITY"); err != nil {
+		return fmt.Errorf("error clearing device data history: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
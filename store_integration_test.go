@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPostgresStore runs the shared-database store against DATABASE_URL, such as the
+// timescaledb service in docker-compose.yml, as HISTORY_STORE (default timescale).
+// It clears the database's history, so don't point it at one whose data you want to keep.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	kind := os.Getenv("HISTORY_STORE")
+	if kind == "" {
+		kind = dialectTimescale
+	}
+	if kind != dialectPostgres && kind != dialectTimescale {
+		t.Skipf("HISTORY_STORE=%s is not a shared-database store", kind)
+	}
+
+	store, err := NewStore(kind, nil)
+	if err != nil {
+		t.Fatalf("opening %s store: %v", kind, err)
+	}
+	defer store.Close()
+	db := store.(*PostgresStore).db
+
+	//opening the store migrated it; running again must be a no-op
+	if applied, err := MigrateUp(db, kind); err != nil || applied != 0 {
+		t.Fatalf("second MigrateUp applied %d migrations, err %v", applied, err)
+	}
+	if err := store.ClearHistory(); err != nil {
+		t.Fatalf("ClearHistory: %v", err)
+	}
+
+	records := []DeviceData{
+		{DeviceSn: "IT-1", DeviceDataTime: "2024-01-02 10:00:00", PvTotalPower: "100", EmsPower: "10"},
+		{DeviceSn: "IT-1", DeviceDataTime: "2024-01-02 10:05:00", PvTotalPower: "200", EmsPower: "20"},
+		{DeviceSn: "IT-1", DeviceDataTime: "2024-01-02 10:10:00", PvTotalPower: "300", EmsPower: "30"},
+	}
+	if err := store.SaveHistory(records); err != nil {
+		t.Fatalf("SaveHistory: %v", err)
+	}
+	//the same sample again, with a new value, updates in place
+	records[1].PvTotalPower = "250"
+	if err := store.SaveHistory(records[1:2]); err != nil {
+		t.Fatalf("SaveHistory upsert: %v", err)
+	}
+
+	first, err := store.HistoryPage(HistoryQuery{DeviceSn: "IT-1", Limit: 2})
+	if err != nil {
+		t.Fatalf("HistoryPage: %v", err)
+	}
+	if first.Total != 3 || len(first.Rows) != 2 || first.Next == nil || first.Prev != nil {
+		t.Fatalf("first page: total %d, %d rows, next %v, prev %v; want 3, 2, set, nil", first.Total, len(first.Rows), first.Next, first.Prev)
+	}
+	if got := first.Rows[1].PvTotalPower; got != "250" {
+		t.Errorf("upserted pv_input_power_w = %q, want 250", got)
+	}
+
+	second, err := store.HistoryPage(HistoryQuery{DeviceSn: "IT-1", Limit: 2, After: first.Next})
+	if err != nil {
+		t.Fatalf("HistoryPage after cursor: %v", err)
+	}
+	if len(second.Rows) != 1 || second.Rows[0].LocalTime != "2024-01-02 10:10:00" || second.Next != nil || second.Prev == nil {
+		t.Fatalf("second page: %d rows, next %v, prev %v; want the 10:10 row, nil, set", len(second.Rows), second.Next, second.Prev)
+	}
+
+	//on timescale the hourly bucket comes from device_data_hourly, refreshed over the old samples
+	if err := store.RefreshRollups(TimeRange{}); err != nil {
+		t.Fatalf("RefreshRollups: %v", err)
+	}
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, plantLocation)
+	buckets, err := store.HistoryBuckets(BucketQuery{
+		DeviceSn: "IT-1",
+		Range:    TimeRange{From: day, To: day.AddDate(0, 0, 1)},
+		Origin:   day,
+		Interval: time.Hour,
+		Fields:   []string{"pv_input_power_w"},
+		Fn:       "avg",
+	})
+	if err != nil {
+		t.Fatalf("HistoryBuckets: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].Samples != 3 || math.Abs(buckets[0].Values[0].Float64/float64(buckets[0].Counts[0])-650.0/3) > 1e-6 {
+		t.Fatalf("hourly buckets = %+v, want one of 3 samples averaging %.2f", buckets, 650.0/3)
+	}
+
+	if err := store.ClearHistory(); err != nil {
+		t.Fatalf("ClearHistory: %v", err)
+	}
+	cleared, err := store.HistoryPage(HistoryQuery{DeviceSn: "IT-1", Limit: 2})
+	if err != nil {
+		t.Fatalf("HistoryPage after clear: %v", err)
+	}
+	if cleared.Total != 0 || len(cleared.Rows) != 0 {
+		t.Fatalf("after ClearHistory: total %d, %d rows; want none", cleared.Total, len(cleared.Rows))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DailySummary is one device's plant-local day in daily_summary
+type DailySummary struct {
+	DeviceSn             string   `json:"deviceSn"`
+	Day                  string   `json:"day"` // YYYY-MM-DD
+	PvKWh                float64  `json:"pvKWh"`
+	LoadKWh              float64  `json:"loadKWh"`
+	BatteryChargeKWh     float64  `json:"batteryChargeKWh"`
+	BatteryDischargeKWh  float64  `json:"batteryDischargeKWh"`
+	BatteryVoltageMin    *float64 `json:"batteryVoltageMin"`
+	BatteryVoltageMax    *float64 `json:"batteryVoltageMax"`
+	BatteryPercentageMin *float64 `json:"batteryPercentageMin"`
+	BatteryPercentageMax *float64 `json:"batteryPercentageMax"`
+	PeakLoadW            *float64 `json:"peakLoadW"`
+	PeakPvW              *float64 `json:"peakPvW"`
+	CoverageHours        float64  `json:"coverageHours"`
+	Samples              int      `json:"samples"`
+	UpdatedAt            string   `json:"updatedAt,omitempty"`
+}
+
+// summaryColumns are read for a summary: energyColumns first, as IntegrateEnergy expects,
+// then the columns only the min/max fields need
+var summaryColumns = append(slices.Clone(energyColumns), "battery_voltage_v", "battery_percentage")
+
+// SummarizeDay computes deviceSn's summary for the plant-local day dateStr (YYYY-MM-DD).
+// The boolean is false when the day has no samples.
+func SummarizeDay(store HistoryStore, opts EnergyOptions, deviceSn, dateStr string) (DailySummary, bool, error) {
+	day, err := dayRange(dateStr)
+	if err != nil {
+		return DailySummary{}, false, err
+	}
+	//read a gap either side so the pairs straddling midnight are counted
+	padded := TimeRange{From: day.From.Add(-opts.MaxGap), To: day.To.Add(opts.MaxGap)}
+	samples, err := store.HistorySamples(deviceSn, padded, summaryColumns)
+	if err != nil {
+		return DailySummary{}, false, err
+	}
+
+	summary := DailySummary{DeviceSn: deviceSn, Day: dateStr}
+	for _, totals := range IntegrateEnergy(samples, "day", day, opts) {
+		summary.PvKWh += roundKWh(totals.PvKWh)
+		summary.LoadKWh += roundKWh(totals.LoadKWh)
+		summary.BatteryChargeKWh += roundKWh(totals.BatteryChargeKWh)
+		summary.BatteryDischargeKWh += roundKWh(totals.BatteryDischargeKWh)
+		summary.CoverageHours += math.Round(totals.CoverageHours*100) / 100
+	}
+
+	from, to := day.From.Unix(), day.To.Unix()
+	for _, sample := range samples {
+		if sample.Ts < from || sample.Ts >= to {
+			continue
+		}
+		summary.Samples++
+		pv, load := sample.Values[0], sample.Values[2]
+		voltage, percentage := sample.Values[3], sample.Values[4]
+		summary.PeakPvW = maxOf(summary.PeakPvW, pv)
+		summary.PeakLoadW = maxOf(summary.PeakLoadW, load)
+		summary.BatteryVoltageMin = minOf(summary.BatteryVoltageMin, voltage)
+		summary.BatteryVoltageMax = maxOf(summary.BatteryVoltageMax, voltage)
+		summary.BatteryPercentageMin = minOf(summary.BatteryPercentageMin, percentage)
+		summary.BatteryPercentageMax = maxOf(summary.BatteryPercentageMax, percentage)
+	}
+	return summary, summary.Samples > 0, nil
+}
+
+func minOf(current *float64, value sql.NullFloat64) *float64 {
+	if !value.Valid || (current != nil && *current <= value.Float64) {
+		return current
+	}
+	return &value.Float64
+}
+
+func maxOf(current *float64, value sql.NullFloat64) *float64 {
+	if !value.Valid || (current != nil && *current >= value.Float64) {
+		return current
+	}
+	return &value.Float64
+}
+
+// summaryDays returns the distinct devices and plant-local days that dataList has samples for.
+// A sample within maxGap of midnight also counts for the day on the other side, whose total
+// takes a share of the pair of samples straddling that midnight.
+func summaryDays(dataList []DeviceData, maxGap time.Duration) map[string][]string {
+	days := make(map[string][]string)
+	add := func(deviceSn string, t time.Time) {
+		day := t.Format(backfillDateLayout)
+		if !slices.Contains(days[deviceSn], day) {
+			days[deviceSn] = append(days[deviceSn], day)
+		}
+	}
+	for _, data := range dataList {
+		t, err := parseDeviceTime(data.DeviceDataTime)
+		if err != nil {
+			continue
+		}
+		add(data.DeviceSn, t)
+		midnight := periodStart(t, "day")
+		if t.Sub(midnight) <= maxGap {
+			add(data.DeviceSn, midnight.Add(-time.Nanosecond))
+		}
+		if next := nextPeriod(midnight, "day"); next.Sub(t) <= maxGap {
+			add(data.DeviceSn, next)
+		}
+	}
+	return days
+}
+
+// UpdateDailySummaries recomputes the summary of every device and day that dataList touched
+func UpdateDailySummaries(store Store, opts EnergyOptions, dataList []DeviceData) error {
+	for deviceSn, days := range summaryDays(dataList, opts.MaxGap) {
+		for _, day := range days {
+			if err := RecomputeDailySummary(store, opts, deviceSn, day); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RecomputeDailySummary rebuilds one device's summary for a day from its raw samples
+func RecomputeDailySummary(store Store, opts EnergyOptions, deviceSn, day string) error {
+	summary, ok, err := SummarizeDay(store, opts, deviceSn, day)
+	if err != nil {
+		return fmt.Errorf("error summarizing %s on %s: %w", deviceSn, day, err)
+	}
+	if !ok {
+		return store.DeleteDailySummary(deviceSn, day)
+	}
+	return store.SaveDailySummary(summary)
+}
+
+// SaveDailySummary inserts or replaces a device's summary for a day
+func (s *sqlStore) SaveDailySummary(summary DailySummary) error {
+	_, err := s.db.Exec(s.bind(`
+		INSERT INTO daily_summary (
+			device_sn, day, pv_kwh, load_kwh, battery_charge_kwh, battery_discharge_kwh,
+			battery_voltage_min, battery_voltage_max, battery_percentage_min, battery_percentage_max,
+			peak_load_w, peak_pv_w, coverage_hours, samples, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (device_sn, day) DO UPDATE SET
+			pv_kwh = excluded.pv_kwh,
+			load_kwh = excluded.load_kwh,
+			battery_charge_kwh = excluded.battery_charge_kwh,
+			battery_discharge_kwh = excluded.battery_discharge_kwh,
+			battery_voltage_min = excluded.battery_voltage_min,
+			battery_voltage_max = excluded.battery_voltage_max,
+			battery_percentage_min = excluded.battery_percentage_min,
+			battery_percentage_max = excluded.battery_percentage_max,
+			peak_load_w = excluded.peak_load_w,
+			peak_pv_w = excluded.peak_pv_w,
+			coverage_hours = excluded.coverage_hours,
+			samples = excluded.samples,
+			updated_at = excluded.updated_at`),
+		summary.DeviceSn, summary.Day, summary.PvKWh, summary.LoadKWh, summary.BatteryChargeKWh, summary.BatteryDischargeKWh,
+		summary.BatteryVoltageMin, summary.BatteryVoltageMax, roundedInt(summary.BatteryPercentageMin), roundedInt(summary.BatteryPercentageMax),
+		summary.PeakLoadW, summary.PeakPvW, summary.CoverageHours, summary.Samples)
+	if err != nil {
+		return fmt.Errorf("error saving daily summary for %s on %s: %w", summary.DeviceSn, summary.Day, err)
+	}
+	return nil
+}
+
+// roundedInt converts an optional value for an INTEGER column
+func roundedInt(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return int(math.Round(*v))
+}
+
+// DeleteDailySummary removes a device's summary for a day that no longer has samples
+func (s *sqlStore) DeleteDailySummary(deviceSn, day string) error {
+	if _, err := s.db.Exec(s.bind("DELETE FROM daily_summary WHERE device_sn = ? AND day = ?"), deviceSn, day); err != nil {
+		return fmt.Errorf("error deleting daily summary for %s on %s: %w", deviceSn, day, err)
+	}
+	return nil
+}
+
+// DailySummaries returns the stored summaries for days from to to (inclusive, YYYY-MM-DD,
+// empty for unbounded), for one device when deviceSn is set, ordered by device and day
+func (s *sqlStore) DailySummaries(deviceSn, from, to string) ([]DailySummary, error) {
+	query := `SELECT device_sn, day, pv_kwh, load_kwh, battery_charge_kwh, battery_discharge_kwh,
+		battery_voltage_min, battery_voltage_max, battery_percentage_min, battery_percentage_max,
+		peak_load_w, peak_pv_w, coverage_hours, samples, updated_at
+		FROM daily_summary WHERE 1 = 1`
+	var args []interface{}
+	if deviceSn != "" {
+		query += " AND device_sn = ?"
+		args = append(args, deviceSn)
+	}
+	if from != "" {
+		query += " AND day >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		query += " AND day <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY device_sn, day"
+
+	rows, err := s.db.Query(s.bind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying daily summaries: %w", err)
+	}
+	defer rows.Close()
+
+	summaries := []DailySummary{}
+	for rows.Next() {
+		var summary DailySummary
+		var updatedAt time.Time
+		if err := rows.Scan(&summary.DeviceSn, &summary.Day, &summary.PvKWh, &summary.LoadKWh, &summary.BatteryChargeKWh, &summary.BatteryDischargeKWh,
+			&summary.BatteryVoltageMin, &summary.BatteryVoltageMax, &summary.BatteryPercentageMin, &summary.BatteryPercentageMax,
+			&summary.PeakLoadW, &summary.PeakPvW, &summary.CoverageHours, &summary.Samples, &updatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning daily summary: %w", err)
+		}
+		summary.UpdatedAt = updatedAt.Format(time.RFC3339)
+		summaries = append(summaries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating through daily summaries: %w", err)
+	}
+	return summaries, nil
+}
+
+// DailySummaryHandler serves /api/summary/daily: stored summaries for days from to to
+// (inclusive, YYYY-MM-DD; date for a single day), for one device with device_sn
+func DailySummaryHandler(store SummaryStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to := c.Query("from"), c.Query("to")
+		if date := c.Query("date"); date != "" {
+			if from != "" || to != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "use either date or from/to, not both"})
+				return
+			}
+			from, to = date, date
+		}
+		for _, day := range []string{from, to} {
+			if _, err := time.Parse(backfillDateLayout, day); day != "" && err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid day %q, use YYYY-MM-DD", day)})
+				return
+			}
+		}
+
+		summaries, err := store.DailySummaries(c.Query("device_sn"), from, to)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching daily summaries from database"})
+			return
+		}
+		c.JSON(http.StatusOK, summaries)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSummaryDays(t *testing.T) {
+	days := summaryDays([]DeviceData{
+		{DeviceSn: "A", DeviceDataTime: "2024-01-15 10:00:00"},
+		{DeviceSn: "A", DeviceDataTime: "2024-01-15 12:00:00"},
+		{DeviceSn: "A", DeviceDataTime: "2024-01-16 12:00:00"},
+		{DeviceSn: "B", DeviceDataTime: "2024-01-15 12:00:00"},
+		{DeviceSn: "B", DeviceDataTime: "yesterday"},
+	}, 15*time.Minute)
+	if !slices.Equal(days["A"], []string{"2024-01-15", "2024-01-16"}) || !slices.Equal(days["B"], []string{"2024-01-15"}) || len(days) != 2 {
+		t.Errorf("summaryDays = %v, want A on the 15th and 16th and B on the 15th", days)
+	}
+}
+
+func TestSummaryDaysNearMidnight(t *testing.T) {
+	tests := []struct {
+		name string
+		time string
+		want []string
+	}{
+		{"middle of the day", "2024-01-15 12:00:00", []string{"2024-01-15"}},
+		{"just after midnight", "2024-01-15 00:10:00", []string{"2024-01-15", "2024-01-14"}},
+		{"just before midnight", "2024-01-15 23:50:00", []string{"2024-01-15", "2024-01-16"}},
+		{"exactly MaxGap after midnight", "2024-01-15 00:15:00", []string{"2024-01-15", "2024-01-14"}},
+		{"beyond MaxGap of midnight", "2024-01-15 00:20:00", []string{"2024-01-15"}},
+		{"unparseable time", "yesterday", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days := summaryDays([]DeviceData{{DeviceSn: "A", DeviceDataTime: tt.time}}, 15*time.Minute)
+			if !slices.Equal(days["A"], tt.want) {
+				t.Errorf("summaryDays(%q) = %v, want %v", tt.time, days["A"], tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeDay(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := MigrateUp(db, dialectSQLite); err != nil {
+		t.Fatal(err)
+	}
+	store := NewSQLiteStore(db)
+	opts := EnergyOptions{MaxGap: 2 * time.Hour}
+
+	err = store.SaveHistory([]DeviceData{
+		{DeviceSn: "A", DeviceDataTime: "2024-01-15 10:00:00", PvTotalPower: "1000", EmsVoltage: "50", AcOutputVolt: "230", AcOutputCurr: "2"},
+		{DeviceSn: "A", DeviceDataTime: "2024-01-15 11:00:00", PvTotalPower: "1000", EmsVoltage: "52", AcOutputVolt: "230", AcOutputCurr: "2"},
+		{DeviceSn: "A", DeviceDataTime: "2024-01-16 10:00:00", PvTotalPower: "500"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, ok, err := SummarizeDay(store, opts, "A", "2024-01-15")
+	if err != nil || !ok {
+		t.Fatalf("SummarizeDay = %v, %v", ok, err)
+	}
+	if summary.Samples != 2 || !near(summary.PvKWh, 1) || !near(summary.LoadKWh, 0.46) || !near(summary.CoverageHours, 1) {
+		t.Errorf("summary = %+v, want 2 samples, 1 kWh pv, 0.46 kWh load over 1h", summary)
+	}
+	if summary.BatteryVoltageMin == nil || *summary.BatteryVoltageMin != 50 || summary.BatteryVoltageMax == nil || *summary.BatteryVoltageMax != 52 {
+		t.Errorf("battery voltage %v..%v, want 50..52", summary.BatteryVoltageMin, summary.BatteryVoltageMax)
+	}
+	if summary.PeakPvW == nil || *summary.PeakPvW != 1000 || summary.PeakLoadW == nil || *summary.PeakLoadW != 460 {
+		t.Errorf("peaks pv %v, load %v; want 1000 and 460", summary.PeakPvW, summary.PeakLoadW)
+	}
+
+	if _, ok, err := SummarizeDay(store, opts, "A", "2024-01-14"); err != nil || ok {
+		t.Errorf("day without samples: ok %v, err %v; want false, nil", ok, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" //the runtime image ships without zoneinfo
+)
+
+// plantLocation is the time zone the inverters report their local times in,
+// set from PLANT_TIMEZONE by setPlantTimezone
+var plantLocation = time.Local
+
+// setPlantTimezone sets plantLocation from an IANA zone name; empty keeps the server's zone
+func setPlantTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid PLANT_TIMEZONE %q: %w", name, err)
+	}
+	plantLocation = loc
+	return nil
+}
+
+// deviceTimeLayouts are the formats device times have been seen in, tried in order
+var deviceTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04",
+}
+
+// parseDeviceTime parses a device-reported time. Times without an offset are plant-local;
+// bare integers are Unix seconds or, when large enough, milliseconds.
+func parseDeviceTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty device time")
+	}
+
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch > 1e12 {
+			return time.UnixMilli(epoch).In(plantLocation), nil
+		}
+		return time.Unix(epoch, 0).In(plantLocation), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(plantLocation), nil
+	}
+	for _, layout := range deviceTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, plantLocation); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised device time %q", value)
+}
+
+// deviceTimestamp returns the UTC epoch seconds of a device time, or nil when it can't be parsed
+func deviceTimestamp(value string) interface{} {
+	t, err := parseDeviceTime(value)
+	if err != nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+// parseTimeParam parses a query parameter given as RFC 3339 or as a plant-local
+// date (YYYY-MM-DD), which means midnight at the start of that day.
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(backfillDateLayout, value, plantLocation); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 (2024-01-02T15:04:05Z) or YYYY-MM-DD", value)
+}
+
+// TimeRange is a half-open [From, To) range; a zero bound is unbounded
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseTimeRange reads from/to query values. A date-only "to" includes that whole day.
+func parseTimeRange(fromStr, toStr string) (TimeRange, error) {
+	var r TimeRange
+	var err error
+	if fromStr != "" {
+		if r.From, err = parseTimeParam(fromStr); err != nil {
+			return r, err
+		}
+	}
+	if toStr != "" {
+		if r.To, err = parseTimeParam(toStr); err != nil {
+			return r, err
+		}
+		if len(toStr) == len(backfillDateLayout) {
+			r.To = r.To.AddDate(0, 0, 1)
+		}
+	}
+	if !r.From.IsZero() && !r.To.IsZero() && !r.From.Before(r.To) {
+		return r, fmt.Errorf("from must be before to")
+	}
+	return r, nil
+}
+
+// dayRange returns the plant-local day dateStr (YYYY-MM-DD) as a range
+func dayRange(dateStr string) (TimeRange, error) {
+	start, err := time.ParseInLocation(backfillDateLayout, dateStr, plantLocation)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD", dateStr)
+	}
+	return TimeRange{From: start, To: start.AddDate(0, 0, 1)}, nil
+}
+
+// conditions returns SQL conditions restricting an epoch-seconds column to the range
+func (r TimeRange) conditions(column string) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if !r.From.IsZero() {
+		conditions = append(conditions, column+" >= ?")
+		args = append(args, r.From.Unix())
+	}
+	if !r.To.IsZero() {
+		conditions = append(conditions, column+" < ?")
+		args = append(args, r.To.Unix())
+	}
+	return conditions, args
+}
+
+// formatTimestamp renders epoch seconds as RFC 3339 in the plant's zone, falling back
+// to the stored local string for rows whose time never parsed
+func formatTimestamp(ts sql.NullInt64, fallback string) string {
+	if !ts.Valid {
+		return fallback
+	}
+	return time.Unix(ts.Int64, 0).In(plantLocation).Format(time.RFC3339)
+}
+
+// isoDeviceTime re-renders a stored device time as RFC 3339, leaving unparseable values as they are
+func isoDeviceTime(value string) string {
+	t, err := parseDeviceTime(value)
+	if err != nil {
+		return value
+	}
+	return t.Format(time.RFC3339)
+}
+
+// plantToday is today's date in the plant's zone, the form the history API is queried by
+func plantToday() time.Time {
+	return time.Now().In(plantLocation)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before expiry a token is treated as stale
+const tokenExpiryMargin = time.Minute
+
+// TokenManager owns the Felicity tokens in memory and hands out a valid access token,
+// refreshing or logging in again when needed. Concurrent callers share a single renewal.
+type TokenManager struct {
+	client   *FelicityClient
+	username string
+	password string
+	store    TokenStore
+
+	mu       sync.Mutex
+	tokens   *StoredTokens
+	loaded   bool
+	inflight *tokenCall
+}
+
+// tokenCall tracks a renewal in progress so concurrent callers can wait on it
+type tokenCall struct {
+	done   chan struct{}
+	forced bool       // a full login, skipping the refresh token
+	next   *tokenCall // forced renewal queued behind this one, if any
+	tokens *StoredTokens
+	err    error
+}
+
+func NewTokenManager(client *FelicityClient, username, password string, store TokenStore) *TokenManager {
+	return &TokenManager{
+		client:   client,
+		username: username,
+		password: password,
+		store:    store,
+	}
+}
+
+// Token returns a valid access token, renewing it first if it is missing or about to expire
+func (tm *TokenManager) Token(ctx context.Context) (string, error) {
+	tm.mu.Lock()
+	tm.ensureLoaded()
+
+	if tm.tokens != nil && tm.tokens.AccessToken != "" && time.Now().Add(tokenExpiryMargin).Before(tm.tokens.AccessTokenExpiry) {
+		accessToken := tm.tokens.AccessToken
+		tm.mu.Unlock()
+		return accessToken, nil
+	}
+
+	call := tm.startRenewal(false)
+	tm.mu.Unlock()
+
+	tokens, err := call.wait(ctx)
+	if err != nil {
+		return "", err
+	}
+	return tokens.AccessToken, nil
+}
+
+// Renew renews the tokens regardless of their expiry. With forceLogin set the refresh
+// token is skipped and a full login is performed.
+func (tm *TokenManager) Renew(ctx context.Context, forceLogin bool) (*StoredTokens, error) {
+	tm.mu.Lock()
+	tm.ensureLoaded()
+	call := tm.startRenewal(forceLogin)
+	tm.mu.Unlock()
+
+	return call.wait(ctx)
+}
+
+// Invalidate marks accessToken as unusable after the server rejected it, so the next Token call
+// renews it. Tokens that have already been replaced are left alone.
+func (tm *TokenManager) Invalidate(accessToken string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.tokens == nil || tm.tokens.AccessToken != accessToken {
+		return
+	}
+	tokens := *tm.tokens
+	tokens.AccessTokenExpiry = time.Time{}
+	tm.tokens = &tokens
+}
+
+// Snapshot returns a copy of the current tokens, or nil if none are held
+func (tm *TokenManager) Snapshot() *StoredTokens {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.ensureLoaded()
+
+	if tm.tokens == nil {
+		return nil
+	}
+	tokens := *tm.tokens
+	return &tokens
+}
+
+// ensureLoaded reads tokens from the store on first use; tm.mu must be held
+func (tm *TokenManager) ensureLoaded() {
+	if tm.loaded {
+		return
+	}
+	storedTokens, err := tm.store.Load()
+	if err != nil {
+		fmt.Println("Error loading stored tokens:", err)
+	}
+	tm.tokens = storedTokens
+	tm.loaded = true
+}
+
+// startRenewal joins the renewal in progress or starts a new one; tm.mu must be held.
+// A forced renewal never joins a plain one, which may only refresh: it is queued to
+// run once that finishes, shared by every forced caller arriving in the meantime.
+func (tm *TokenManager) startRenewal(forceLogin bool) *tokenCall {
+	if inflight := tm.inflight; inflight != nil {
+		if !forceLogin || inflight.forced {
+			return inflight
+		}
+		if inflight.next == nil {
+			inflight.next = &tokenCall{done: make(chan struct{}), forced: true}
+		}
+		return inflight.next
+	}
+	call := &tokenCall{done: make(chan struct{}), forced: forceLogin}
+	tm.inflight = call
+	//renewal runs detached so one caller giving up doesn't fail the others
+	go tm.renew(call, tm.tokens)
+	return call
+}
+
+func (call *tokenCall) wait(ctx context.Context) (*StoredTokens, error) {
+	select {
+	case <-call.done:
+		return call.tokens, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// renew refreshes the access token, falling back to a full login when refresh isn't possible,
+// then starts the forced renewal queued behind it
+func (tm *TokenManager) renew(call *tokenCall, current *StoredTokens) {
+	tokens, err := tm.obtainTokens(current, call.forced)
+
+	tm.mu.Lock()
+	if err == nil {
+		tm.tokens = tokens
+	}
+	tm.inflight = call.next
+	if call.next != nil {
+		go tm.renew(call.next, tm.tokens)
+	}
+	tm.mu.Unlock()
+
+	call.tokens = tokens
+	call.err = err
+	close(call.done)
+}
+
+func (tm *TokenManager) obtainTokens(current *StoredTokens, forceLogin bool) (*StoredTokens, error) {
+	//not tied to any caller's context; the client timeout bounds each call
+	ctx := context.Background()
+
+	if !forceLogin && current != nil && current.RefreshToken != "" && time.Now().Before(current.RefreshTokenExpiry) {
+		fmt.Println("Attempting access token refresh.")
+		tokens, err := tm.client.RefreshAccessToken(ctx, current.RefreshToken)
+		if err == nil {
+			metrics.TokenRefreshes.Add(1)
+			fmt.Println("Access token refreshed successfully.")
+			tm.persist(tokens)
+			return tokens, nil
+		}
+		fmt.Println("Refresh failed:", err)
+	} else if !forceLogin {
+		fmt.Println("No usable refresh token.")
+	}
+
+	fmt.Println("Attempting to log in again...")
+	tokens, err := performLogin(ctx, tm.client, tm.username, tm.password)
+	if err != nil {
+		metrics.TokenRenewFailures.Add(1)
+		return nil, fmt.Errorf("automatic login failed: %w", err)
+	}
+	metrics.TokenLogins.Add(1)
+	tm.persist(tokens)
+	return tokens, nil
+}
+
+// persist writes tokens to the store; a failed write is logged since the in-memory copy is still usable
+func (tm *TokenManager) persist(tokens *StoredTokens) {
+	if err := tm.store.Save(tokens); err != nil {
+		fmt.Println("Error saving tokens:", err)
+		return
+	}
+	fmt.Println("Tokens saved.")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenRefresher keeps the tokens held by a TokenManager warm in the background:
+// the access token is refreshed ahead of its expiry and a fresh login is done before
+// the refresh token itself runs out.
+type TokenRefresher struct {
+	tm          *TokenManager
+	refreshLead time.Duration // refresh this long before AccessTokenExpiry
+	reloginLead time.Duration // log in again this long before RefreshTokenExpiry
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu     sync.Mutex
+	status TokenRefresherStatus
+}
+
+// TokenRefresherStatus reports the current token expiries and last refresh outcome
+type TokenRefresherStatus struct {
+	AccessTokenExpiry  *time.Time `json:"accessTokenExpiry"`
+	RefreshTokenExpiry *time.Time `json:"refreshTokenExpiry"`
+	LastAttempt        *time.Time `json:"lastAttempt"`
+	LastSuccess        *time.Time `json:"lastSuccess"`
+	LastAction         string     `json:"lastAction"`
+	LastOutcome        string     `json:"lastOutcome"`
+	LastError          string     `json:"lastError,omitempty"`
+	ConsecutiveFails   int        `json:"consecutiveFailures"`
+	NextRun            *time.Time `json:"nextRun"`
+}
+
+func NewTokenRefresher(tm *TokenManager, refreshLead, reloginLead time.Duration) *TokenRefresher {
+	return &TokenRefresher{
+		tm:          tm,
+		refreshLead: refreshLead,
+		reloginLead: reloginLead,
+		minBackoff:  30 * time.Second,
+		maxBackoff:  15 * time.Minute,
+	}
+}
+
+// Run schedules refreshes until ctx is cancelled
+func (r *TokenRefresher) Run(ctx context.Context) {
+	for {
+		delay := r.nextDelay()
+		next := time.Now().Add(delay)
+
+		r.mu.Lock()
+		r.status.NextRun = &next
+		r.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		r.runOnce(ctx)
+	}
+}
+
+// nextDelay works out how long to sleep before the next refresh attempt
+func (r *TokenRefresher) nextDelay() time.Duration {
+	r.mu.Lock()
+	failures := r.status.ConsecutiveFails
+	r.mu.Unlock()
+
+	if failures > 0 {
+		return r.backoff(failures)
+	}
+
+	tokens := r.tm.Snapshot()
+	if tokens == nil || tokens.AccessToken == "" {
+		return 0
+	}
+
+	refreshAt := tokens.AccessTokenExpiry.Add(-r.refreshLead)
+	reloginAt := tokens.RefreshTokenExpiry.Add(-r.reloginLead)
+	next := refreshAt
+	if reloginAt.Before(next) {
+		next = reloginAt
+	}
+	//never spin: if the lead exceeds the token lifetime, requests still refresh lazily via Token
+	return max(time.Until(next), r.minBackoff)
+}
+
+// backoff returns an exponential delay with full jitter, capped at maxBackoff
+func (r *TokenRefresher) backoff(failures int) time.Duration {
+	delay := r.minBackoff
+	for i := 1; i < failures && delay < r.maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, r.maxBackoff)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (r *TokenRefresher) runOnce(ctx context.Context) {
+	action := "refresh"
+	forceLogin := false
+	if tokens := r.tm.Snapshot(); tokens == nil || !time.Now().Before(tokens.RefreshTokenExpiry.Add(-r.reloginLead)) {
+		action = "login"
+		forceLogin = true
+	}
+
+	started := time.Now()
+	_, err := r.tm.Renew(ctx, forceLogin)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.LastAttempt = &started
+	r.status.LastAction = action
+	if err != nil {
+		fmt.Printf("Background token %s failed: %v\n", action, err)
+		r.status.LastOutcome = "failed"
+		r.status.LastError = err.Error()
+		r.status.ConsecutiveFails++
+		return
+	}
+	fmt.Printf("Background token %s succeeded.\n", action)
+	r.status.LastOutcome = "ok"
+	r.status.LastError = ""
+	r.status.LastSuccess = &started
+	r.status.ConsecutiveFails = 0
+}
+
+// Status returns the refresher state together with the current token expiries
+func (r *TokenRefresher) Status() TokenRefresherStatus {
+	r.mu.Lock()
+	status := r.status
+	r.mu.Unlock()
+
+	if tokens := r.tm.Snapshot(); tokens != nil {
+		status.AccessTokenExpiry = &tokens.AccessTokenExpiry
+		status.RefreshTokenExpiry = &tokens.RefreshTokenExpiry
+	}
+	return status
+}
+
+// TokenStatusHandler serves the refresher status without exposing the tokens themselves
+func TokenStatusHandler(r *TokenRefresher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, r.Status())
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TokenStore persists StoredTokens between runs. Load returns nil tokens and no error
+// when nothing has been stored yet.
+type TokenStore interface {
+	Load() (*StoredTokens, error)
+	Save(tokens *StoredTokens) error
+}
+
+// NewTokenStore builds the store selected by TOKEN_STORE: "file" (default), "sqlite" or "encrypted"
+func NewTokenStore(kind string, db *sql.DB) (TokenStore, error) {
+	path := os.Getenv("TOKEN_FILE")
+
+	switch kind {
+	case "", "file":
+		if path == "" {
+			path = defaultTokenFile
+		}
+		return &FileTokenStore{Path: path}, nil
+	case "sqlite":
+		return NewSQLiteTokenStore(db), nil
+	case "encrypted":
+		if path == "" {
+			path = defaultEncryptedTokenFile
+		}
+		return NewEncryptedFileTokenStore(path, os.Getenv("TOKEN_ENCRYPTION_KEY"))
+	default:
+		return nil, fmt.Errorf("unknown token store %q (expected file, sqlite or encrypted)", kind)
+	}
+}
+
+const defaultTokenFile = "tokens.json"
+const defaultEncryptedTokenFile = "tokens.enc"
+
+// FileTokenStore keeps tokens as plaintext JSON on disk
+type FileTokenStore struct {
+	Path string
+}
+
+func (s *FileTokenStore) Load() (*StoredTokens, error) {
+	tokenJSON, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) { // File doesn't exist - that's OK on first run
+			return nil, nil // Return nil tokens, no error
+		}
+		return nil, fmt.Errorf("error reading tokens from file: %w", err)
+	}
+
+	var tokens StoredTokens
+	err = json.Unmarshal(tokenJSON, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling tokens from JSON: %w", err)
+	}
+	return &tokens, nil
+}
+
+func (s *FileTokenStore) Save(tokens *StoredTokens) error {
+	tokenJSON, err := json.MarshalIndent(tokens, "", "  ") // Pretty JSON formatting
+	if err != nil {
+		return fmt.Errorf("error marshaling tokens to JSON: %w", err)
+	}
+	err = os.WriteFile(s.Path, tokenJSON, 0600) // 0600: read/write for owner only (secure file permissions)
+	if err != nil {
+		return fmt.Errorf("error writing tokens to file: %w", err)
+	}
+	return nil
+}
+
+// SQLiteTokenStore keeps tokens in a single row of the device database
+type SQLiteTokenStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteTokenStore(db *sql.DB) *SQLiteTokenStore {
+	return &SQLiteTokenStore{db: db}
+}
+
+func (s *SQLiteTokenStore) Load() (*StoredTokens, error) {
+	var tokens StoredTokens
+	err := s.db.QueryRow("SELECT access_token, refresh_token, access_token_expiry, refresh_token_expiry FROM auth_tokens WHERE id = 1").Scan(
+		&tokens.AccessToken, &tokens.RefreshToken, &tokens.AccessTokenExpiry, &tokens.RefreshTokenExpiry,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens from database: %w", err)
+	}
+	return &tokens, nil
+}
+
+func (s *SQLiteTokenStore) Save(tokens *StoredTokens) error {
+	_, err := s.db.Exec(`
+		INSERT INTO auth_tokens (id, access_token, refresh_token, access_token_expiry, refresh_token_expiry, updated_at)
+		VALUES (1, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(id) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token,
+			access_token_expiry = excluded.access_token_expiry,
+			refresh_token_expiry = excluded.refresh_token_expiry,
+			updated_at = excluded.updated_at
+	`, tokens.AccessToken, tokens.RefreshToken, tokens.AccessTokenExpiry, tokens.RefreshTokenExpiry)
+	if err != nil {
+		return fmt.Errorf("error writing tokens to database: %w", err)
+	}
+	return nil
+}
+
+// EncryptedFileTokenStore keeps tokens on disk sealed with AES-256-GCM.
+// The key is derived from a secret supplied through the environment.
+type EncryptedFileTokenStore struct {
+	Path string
+	aead cipher.AEAD
+}
+
+func NewEncryptedFileTokenStore(path, secret string) (*EncryptedFileTokenStore, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEY must be set for the encrypted token store")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM: %w", err)
+	}
+	return &EncryptedFileTokenStore{Path: path, aead: aead}, nil
+}
+
+func (s *EncryptedFileTokenStore) Load() (*StoredTokens, error) {
+	sealed, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading tokens from file: %w", err)
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("encrypted token file is truncated")
+	}
+	tokenJSON, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting tokens (wrong TOKEN_ENCRYPTION_KEY?): %w", err)
+	}
+
+	var tokens StoredTokens
+	if err := json.Unmarshal(tokenJSON, &tokens); err != nil {
+		return nil, fmt.Errorf("error unmarshaling tokens from JSON: %w", err)
+	}
+	return &tokens, nil
+}
+
+func (s *EncryptedFileTokenStore) Save(tokens *StoredTokens) error {
+	tokenJSON, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("error marshaling tokens to JSON: %w", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+	//file layout: nonce followed by ciphertext+tag
+	sealed := s.aead.Seal(nonce, nonce, tokenJSON, nil)
+
+	if err := os.WriteFile(s.Path, sealed, 0600); err != nil {
+		return fmt.Errorf("error writing tokens to file: %w", err)
+	}
+	return nil
+}